@@ -1,51 +1,191 @@
 package config
 
 import (
-	"net"
 	"os"
-	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/taodev/go-utils"
 )
 
+// ssh 断线重连配置, 为 0 时使用默认值
+type ReconnectConfig struct {
+	// 首次重连等待时间, 之后每次翻倍, 默认 1s
+	MinInterval time.Duration `yaml:"min_interval"`
+	// 最大重连等待时间, 默认 1m
+	MaxInterval time.Duration `yaml:"max_interval"`
+	// 等待时间的随机抖动比例 (0~1), 默认 0.2
+	Jitter float64 `yaml:"jitter"`
+	// 连续失败多少次后进入 failed 状态, 默认 5
+	MaxRetries int `yaml:"max_retries"`
+}
+
 type SSHConfig struct {
 	URL          string `yaml:"url"`
 	IdentityFile string `yaml:"identity_file"`
+	// 认证方式, 按顺序尝试: publickey, password, keyboard-interactive, agent, 默认 publickey
+	Auth []string `yaml:"auth"`
+	// password 和 keyboard-interactive 使用的密码, 依次从 password, password_env, password_file 读取
+	Password     string `yaml:"password"`
+	PasswordEnv  string `yaml:"password_env"`
+	PasswordFile string `yaml:"password_file"`
+	// 加密私钥的密码, 读取顺序同上
+	Passphrase     string `yaml:"passphrase"`
+	PassphraseEnv  string `yaml:"passphrase_env"`
+	PassphraseFile string `yaml:"passphrase_file"`
+	// OpenSSH 证书, 默认使用 identity_file-cert.pub (如果存在)
+	CertificateFile string `yaml:"certificate_file"`
+	// 主机密钥校验策略: strict, accept-new, insecure, 默认 accept-new
+	HostKeyPolicy string `yaml:"host_key_policy"`
+	// known_hosts 文件路径, 默认 known_hosts
+	KnownHosts string `yaml:"known_hosts"`
+	// 固定的主机密钥指纹, 如 SHA256:xxxx, 配置后忽略 known_hosts
+	HostKeys []string `yaml:"host_keys"`
+	// 连接池大小, 默认 10
+	PoolSize int `yaml:"pool_size"`
+	// 多个上游时的优先级, 数值越小越优先
+	Priority int `yaml:"priority"`
+	// 断线重连
+	Reconnect ReconnectConfig `yaml:"reconnect"`
+	// 跳板机, 按顺序连接, 每一跳使用各自的认证和主机密钥配置
+	Jump []SSHConfig `yaml:"jump"`
 }
 
-type NodeConfig struct {
-	Addr      string              `yaml:"addr"`
-	SSH       SSHConfig           `yaml:"ssh"`
-	Anonymous string              `yaml:"anonymous"`
-	Matches   map[string][]string `yaml:"matches"`
+// 路由规则, 按顺序匹配, 第一条命中的规则生效
+type RuleConfig struct {
+	// domain, domain_suffix, domain_keyword, domain_regex, glob, ip_cidr, port, geoip, final
+	Type   string   `yaml:"type"`
+	Values []string `yaml:"values"`
+	// direct, ssh, bridge, reject
+	// socks5 UDP 经 ssh 或 bridge 转发时只支持 53 端口的 DNS 查询 (改为 DNS over TCP), 其他 UDP 数据包会被丢弃
+	Action string `yaml:"action"`
+	// action 为 bridge 时的跳板地址
+	Bridge string `yaml:"bridge,omitempty"`
 }
 
-func (node *NodeConfig) Match(url string) (proxy string, ok bool) {
-	if len(node.Matches) <= 0 {
-		return
+// 代理认证用户, 密码可以是明文或 bcrypt 哈希 ($2a$/$2b$/$2y$)
+type UserConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// 未命中路由规则时按 IP 归属地决定直连还是走隧道
+type GeoIPRuleConfig struct {
+	// 直连的国家代码 (ISO 3166-1), 未配置时默认为 CN
+	Direct []string `yaml:"direct"`
+	// 总是走隧道的国家代码, 优先于 Direct
+	Tunnel []string `yaml:"tunnel"`
+}
+
+func (c *GeoIPRuleConfig) DirectCountries() []string {
+	if c.Direct == nil {
+		return []string{"CN"}
 	}
 
-	h, _, err := net.SplitHostPort(url)
-	if err != nil {
-		h = url
+	return c.Direct
+}
+
+// 多个 ssh 上游的故障切换配置
+type FailoverConfig struct {
+	// 健康检查及测速间隔, 默认 30s
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// 上游选择策略: priority 按优先级 (默认), latency 按延迟
+	Strategy string `yaml:"strategy"`
+	// latency 策略下, 其他上游的延迟比当前上游低出该比例才切换, 默认 0.2
+	Hysteresis float64 `yaml:"hysteresis"`
+}
+
+// http 代理配置
+type HTTPConfig struct {
+	// 请求头最大长度, 默认 64KB
+	MaxHeaderSize int `yaml:"max_header_size"`
+	// 转发的请求中添加 Via
+	Via bool `yaml:"via"`
+	// 转发的请求中添加 X-Forwarded-For
+	ForwardedFor bool `yaml:"forwarded_for"`
+	// 删除客户端发送的 Via, X-Forwarded-For, Forwarded 等请求头, 隐藏来源
+	StripForwarded bool `yaml:"strip_forwarded"`
+	// 在 /proxy.pac 提供根据路由规则生成的 PAC 文件, 不需要代理认证
+	PAC bool `yaml:"pac"`
+}
+
+type NodeConfig struct {
+	Addr string    `yaml:"addr"`
+	SSH  SSHConfig `yaml:"ssh"`
+	// 多个 ssh 上游, 配置后忽略 SSH
+	Upstreams []SSHConfig    `yaml:"upstreams"`
+	Failover  FailoverConfig `yaml:"failover"`
+	Anonymous string         `yaml:"anonymous"`
+	// 代理认证用户, 为空时不需要认证
+	Users []UserConfig    `yaml:"users"`
+	Rules []RuleConfig    `yaml:"rules"`
+	GeoIP GeoIPRuleConfig `yaml:"geoip"`
+	HTTP  HTTPConfig      `yaml:"http"`
+	// Deprecated: 使用 Rules, 保留用于兼容旧配置
+	Matches map[string][]string `yaml:"matches,omitempty"`
+}
+
+// 返回所有 ssh 上游
+func (node *NodeConfig) SSHUpstreams() []SSHConfig {
+	if len(node.Upstreams) > 0 {
+		return node.Upstreams
 	}
 
-	for k, v := range node.Matches {
-		for _, j := range v {
-			if ok, _ = filepath.Match(j, h); ok {
-				proxy = k
-				return
-			}
-		}
+	return []SSHConfig{node.SSH}
+}
+
+// 返回完整的路由规则列表, 旧的 Matches 按跳板名排序后追加在 Rules 之后
+func (node *NodeConfig) RouteRules() (rules []RuleConfig) {
+	rules = append(rules, node.Rules...)
+
+	bridges := make([]string, 0, len(node.Matches))
+	for k := range node.Matches {
+		bridges = append(bridges, k)
+	}
+	sort.Strings(bridges)
+
+	for _, k := range bridges {
+		rules = append(rules, RuleConfig{
+			Type:   "glob",
+			Values: node.Matches[k],
+			Action: "bridge",
+			Bridge: k,
+		})
 	}
 
 	return
 }
 
+// DNS 缓存配置, 为 0 时使用默认值
+type DNSCacheConfig struct {
+	// 最大缓存条数
+	Size int `yaml:"size"`
+	// 解析成功的缓存时间
+	TTL time.Duration `yaml:"ttl"`
+	// 解析失败的缓存时间
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+}
+
+// GeoIP 数据库配置
+type GeoIPConfig struct {
+	// 下载地址, 为空时使用默认地址
+	URL string `yaml:"url"`
+	// 本地保存路径, 默认 geoip.mmdb
+	Path string `yaml:"path"`
+	// 可选, 下载文件的 SHA256 校验值 (hex)
+	SHA256 string `yaml:"sha256"`
+	// 自动更新间隔, 如 24h, 为 0 时不自动更新
+	UpdateInterval time.Duration `yaml:"update_interval"`
+	// 查询归属地时使用的 DNS 缓存
+	DNSCache DNSCacheConfig `yaml:"dns_cache"`
+}
+
 type Config struct {
 	Addr   string                `yaml:"addr"`
+	GeoIP  GeoIPConfig           `yaml:"geoip"`
 	Http   map[string]NodeConfig `yaml:"http"`
 	Socks5 map[string]NodeConfig `yaml:"socks5"`
+	Mixed  map[string]NodeConfig `yaml:"mixed"` // 同一端口同时支持 http 和 socks4/5
 	VPN    map[string]NodeConfig `yaml:"vpn"`
 }
 
@@ -69,10 +209,19 @@ func Default(path string) (err error) {
 		SSH: SSHConfig{
 			URL:          "goway@localhost:22",
 			IdentityFile: "./id_goway",
+			PoolSize:     10,
 		},
 		Anonymous: "127.0.0.1:3128",
-		Matches: map[string][]string{
-			"us1.godev.top:3128": []string{"*.openai.com"},
+		Rules: []RuleConfig{
+			{
+				Type:   "domain_suffix",
+				Values: []string{"openai.com"},
+				Action: "bridge",
+				Bridge: "us1.godev.top:3128",
+			},
+		},
+		GeoIP: GeoIPRuleConfig{
+			Direct: []string{"CN"},
 		},
 	}
 
@@ -3,7 +3,6 @@ module github.com/taodev/goway
 go 1.20
 
 require (
-	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
 	github.com/bytedance/gopkg v0.0.0-20230531144706-a12972768317
 	github.com/oschwald/geoip2-golang v1.8.0
 	github.com/taodev/go-utils v0.0.0-20230513091238-b73d3dfa8ddd
@@ -12,7 +11,6 @@ require (
 
 require (
 	github.com/oschwald/maxminddb-golang v1.10.0 // indirect
-	golang.org/x/net v0.11.0 // indirect
 	golang.org/x/sys v0.9.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
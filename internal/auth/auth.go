@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+	"sync"
+
+	"github.com/taodev/goway/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 代理用户认证, 密码支持明文和 bcrypt 哈希
+type Users struct {
+	passwords map[string]string
+
+	// 已验证通过的 bcrypt 凭据, 避免每个连接都计算一次 bcrypt
+	verified sync.Map
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") ||
+		strings.HasPrefix(password, "$2b$") ||
+		strings.HasPrefix(password, "$2y$")
+}
+
+// 是否需要认证
+func (u *Users) Enabled() bool {
+	return u != nil && len(u.passwords) > 0
+}
+
+func (u *Users) Verify(username, password string) bool {
+	expected, ok := u.passwords[username]
+	if !ok {
+		return false
+	}
+
+	if !isBcrypt(expected) {
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	if _, ok = u.verified.Load(key); ok {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) != nil {
+		return false
+	}
+
+	u.verified.Store(key, true)
+	return true
+}
+
+func NewUsers(users []config.UserConfig) (u *Users) {
+	u = &Users{
+		passwords: make(map[string]string, len(users)),
+	}
+
+	for _, v := range users {
+		u.passwords[v.Username] = v.Password
+	}
+
+	return
+}
@@ -1,41 +1,161 @@
 package geoip
 
 import (
+	"container/list"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	DEFAULT_DNS_CACHE_SIZE   = 4096
+	DEFAULT_DNS_TTL          = 10 * time.Minute
+	DEFAULT_DNS_NEGATIVE_TTL = 30 * time.Second
+)
+
+type dnsEntry struct {
+	domain string
+	ip     net.IP
+	ok     bool
+	expire time.Time
+}
+
+// 正在进行的解析, 相同域名的并发查询共享结果
+type dnsCall struct {
+	wg sync.WaitGroup
+	ip net.IP
+	ok bool
+}
+
+type DNSCacheInfo struct {
+	Size   int
+	Hits   int64
+	Misses int64
+}
+
 // DNSCache
 type DNSCache struct {
-	dnsCache       map[string]net.IP
+	MaxSize     int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*dnsCall
+
 	dnsCacheLocker sync.Mutex
+
+	hits   int64
+	misses int64
 }
 
 // 查询并保存DNS缓存
 func (cache *DNSCache) Query(domain string) (ip net.IP, ok bool) {
 	cache.dnsCacheLocker.Lock()
-	defer cache.dnsCacheLocker.Unlock()
 
-	ip, ok = cache.dnsCache[domain]
-	if !ok {
-		addr, err := net.ResolveIPAddr("ip", domain)
-		if err != nil {
-			return
+	if e, found := cache.entries[domain]; found {
+		entry := e.Value.(*dnsEntry)
+		if time.Now().Before(entry.expire) {
+			cache.lru.MoveToFront(e)
+			cache.dnsCacheLocker.Unlock()
+
+			atomic.AddInt64(&cache.hits, 1)
+			return entry.ip, entry.ok
 		}
 
-		ok = true
-		ip = addr.IP
-		cache.dnsCache[domain] = ip
+		cache.lru.Remove(e)
+		delete(cache.entries, domain)
+	}
+
+	atomic.AddInt64(&cache.misses, 1)
+
+	// 已有相同域名在解析中, 等待其结果
+	if c, found := cache.calls[domain]; found {
+		cache.dnsCacheLocker.Unlock()
+		c.wg.Wait()
+		return c.ip, c.ok
 	}
 
+	c := new(dnsCall)
+	c.wg.Add(1)
+	cache.calls[domain] = c
+	cache.dnsCacheLocker.Unlock()
+
+	// 网络解析不持有锁
+	if addr, err := net.ResolveIPAddr("ip", domain); err == nil {
+		c.ip = addr.IP
+		c.ok = true
+	}
+
+	cache.dnsCacheLocker.Lock()
+	delete(cache.calls, domain)
+	cache.store(domain, c.ip, c.ok)
+	cache.dnsCacheLocker.Unlock()
+
+	c.wg.Done()
+
 	// log.Printf("dns cache: %s -> %s", domain, ip.String())
 
+	return c.ip, c.ok
+}
+
+// 保存解析结果, 解析失败的结果使用 NegativeTTL, 超出 MaxSize 时淘汰最久未使用的记录
+func (cache *DNSCache) store(domain string, ip net.IP, ok bool) {
+	ttl := cache.TTL
+	if !ok {
+		ttl = cache.NegativeTTL
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &dnsEntry{
+		domain: domain,
+		ip:     ip,
+		ok:     ok,
+		expire: time.Now().Add(ttl),
+	}
+	cache.entries[domain] = cache.lru.PushFront(entry)
+
+	for cache.MaxSize > 0 && cache.lru.Len() > cache.MaxSize {
+		e := cache.lru.Back()
+		cache.lru.Remove(e)
+		delete(cache.entries, e.Value.(*dnsEntry).domain)
+	}
+}
+
+func (cache *DNSCache) Stat() (i DNSCacheInfo) {
+	cache.dnsCacheLocker.Lock()
+	i.Size = cache.lru.Len()
+	cache.dnsCacheLocker.Unlock()
+
+	i.Hits = atomic.LoadInt64(&cache.hits)
+	i.Misses = atomic.LoadInt64(&cache.misses)
 	return
 }
 
-// 初始化DNS缓存
-func NewDNSCache() *DNSCache {
+// 初始化DNS缓存, 参数为 0 时使用默认值
+func NewDNSCache(maxSize int, ttl, negativeTTL time.Duration) *DNSCache {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_DNS_CACHE_SIZE
+	}
+
+	if ttl <= 0 {
+		ttl = DEFAULT_DNS_TTL
+	}
+
+	if negativeTTL <= 0 {
+		negativeTTL = DEFAULT_DNS_NEGATIVE_TTL
+	}
+
 	cache := new(DNSCache)
-	cache.dnsCache = make(map[string]net.IP)
+	cache.MaxSize = maxSize
+	cache.TTL = ttl
+	cache.NegativeTTL = negativeTTL
+	cache.entries = make(map[string]*list.Element)
+	cache.lru = list.New()
+	cache.calls = make(map[string]*dnsCall)
 	return cache
 }
@@ -1,101 +1,312 @@
 package geoip
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/oschwald/geoip2-golang"
+	"github.com/taodev/goway/config"
 )
 
 const DOWNLOAD_GEOIP2_URL = "https://raw.githubusercontent.com/Hackl0us/GeoIP2-CN/release/Country.mmdb"
 const GEOIP2_PATH = "geoip.mmdb"
 
 var geoipDB *geoip2.Reader
-var geoipDBLocker sync.Mutex
+var geoipDBLocker sync.RWMutex
+var lastUpdate time.Time
 var dnsCache *DNSCache
 
+var updaterStop chan int
+
+var downloadClient = &http.Client{Timeout: 5 * time.Minute}
+
 func FileExists(filename string) bool {
 	_, err := os.Stat(filename)
 	return err == nil
 }
 
-func Load() (err error) {
-	if !FileExists(GEOIP2_PATH) {
-		cmd := exec.Command("wget", "-O", GEOIP2_PATH, DOWNLOAD_GEOIP2_URL)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+// 下载 GeoIP 数据库, 先写入临时文件, 校验通过后再替换 path
+func Download(url, path, sum string) (err error) {
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("geoip: download %s: %s", url, resp.Status)
+		return
+	}
 
-		err = cmd.Run()
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return
+	}
+
+	tmpPath := f.Name()
+	defer func() {
 		if err != nil {
-			log.Fatalf("下载文件时发生错误：%v", err)
+			os.Remove(tmpPath)
 		}
-	}
+	}()
 
-	geoipDB, err = geoip2.Open(GEOIP2_PATH)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if e := f.Close(); err == nil {
+		err = e
+	}
 	if err != nil {
 		return
 	}
 
-	dnsCache = NewDNSCache()
+	if len(sum) > 0 {
+		if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, sum) {
+			err = fmt.Errorf("geoip: checksum mismatch, want %s got %s", sum, actual)
+			return
+		}
+	}
+
+	if err = os.Chmod(tmpPath, 0644); err != nil {
+		return
+	}
+
+	err = os.Rename(tmpPath, path)
+	return
+}
+
+func dbPath(opts config.GeoIPConfig) (url, path string) {
+	url = opts.URL
+	if len(url) <= 0 {
+		url = DOWNLOAD_GEOIP2_URL
+	}
+
+	path = opts.Path
+	if len(path) <= 0 {
+		path = GEOIP2_PATH
+	}
 
 	return
 }
 
-func Update() (err error) {
+// 读入内存后打开, 之后可以安全地替换磁盘上的文件
+func open(path string) (db *geoip2.Reader, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	return geoip2.FromBytes(data)
+}
+
+// 替换当前数据库, 正在进行的查询持有读锁, 旧库在其结束后才关闭
+func swap(db *geoip2.Reader, t time.Time) {
 	geoipDBLocker.Lock()
-	defer geoipDBLocker.Unlock()
+	old := geoipDB
+	geoipDB = db
+	lastUpdate = t
+	geoipDBLocker.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+func Load(opts config.GeoIPConfig) (err error) {
+	url, path := dbPath(opts)
+
+	if !FileExists(path) {
+		if err = Download(url, path, opts.SHA256); err != nil {
+			return
+		}
+	}
+
+	db, err := open(path)
+	if err != nil {
+		return
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		db.Close()
+		return
+	}
+
+	swap(db, fi.ModTime())
+	dnsCache = NewDNSCache(opts.DNSCache.Size, opts.DNSCache.TTL, opts.DNSCache.NegativeTTL)
+
+	if opts.UpdateInterval > 0 {
+		StartUpdater(opts)
+	}
+
+	return
+}
+
+// 下载新的数据库, 校验可以打开后再替换
+func Update(opts config.GeoIPConfig) (err error) {
+	url, path := dbPath(opts)
+	tmpPath := path + ".new"
+
+	if err = Download(url, tmpPath, opts.SHA256); err != nil {
+		return
+	}
+
+	db, err := open(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		err = fmt.Errorf("geoip: invalid database: %w", err)
+		return
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		db.Close()
+		os.Remove(tmpPath)
+		return
+	}
+
+	swap(db, time.Now())
+	return
+}
+
+// 定时更新数据库
+func StartUpdater(opts config.GeoIPConfig) {
+	StopUpdater()
+
+	updaterStop = make(chan int)
+	stopCH := updaterStop
+
+	go func() {
+		ticker := time.NewTicker(opts.UpdateInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := Update(opts); err != nil {
+					log.Printf("geoip: update failed: %s", err)
+					continue
+				}
+
+				i := Stat()
+				log.Printf("geoip: updated, build: %s", i.BuildTime.Format(time.RFC3339))
+			case <-stopCH:
+				return
+			}
+		}
+	}()
+}
+
+func StopUpdater() {
+	if updaterStop != nil {
+		close(updaterStop)
+		updaterStop = nil
+	}
+}
 
+type Info struct {
+	// 最近一次加载或更新的时间
+	LastUpdate time.Time
+	// 数据库生成时间
+	BuildTime time.Time
+	// DNS 缓存统计
+	DNSCache DNSCacheInfo
+}
+
+func Stat() (i Info) {
+	geoipDBLocker.RLock()
+	defer geoipDBLocker.RUnlock()
+
+	i.LastUpdate = lastUpdate
 	if geoipDB != nil {
-		geoipDB.Close()
-		geoipDB = nil
+		i.BuildTime = time.Unix(int64(geoipDB.Metadata().BuildEpoch), 0)
+	}
+
+	if dnsCache != nil {
+		i.DNSCache = dnsCache.Stat()
 	}
 
-	return Load()
+	return
 }
 
 func Close() {
+	StopUpdater()
+
+	geoipDBLocker.Lock()
+	defer geoipDBLocker.Unlock()
+
 	if geoipDB != nil {
 		geoipDB.Close()
 		geoipDB = nil
 	}
 }
 
-func InPRC(addr string) bool {
-	var err error
+// 解析域名, 使用 DNS 缓存
+func Resolve(host string) (ip net.IP, ok bool) {
+	if ip = net.ParseIP(host); ip != nil {
+		ok = true
+		return
+	}
+
+	return dnsCache.Query(host)
+}
+
+// 判断是否局域网ip
+func IsPrivate(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalMulticast() || ip.IsLinkLocalUnicast()
+}
+
+// 查询IP地址的归属地
+func Country(ip net.IP) (isoCode string, err error) {
+	geoipDBLocker.RLock()
+	defer geoipDBLocker.RUnlock()
+
+	if geoipDB == nil {
+		err = errors.New("geoip: database not loaded")
+		return
+	}
+
+	record, err := geoipDB.Country(ip)
+	if err != nil {
+		return
+	}
+
+	isoCode = record.Country.IsoCode
+	return
+}
+
+// 局域网地址的归属地
+const LAN = "LAN"
+
+// 查询地址的归属地, 返回国家代码, 局域网地址返回 LAN
+func Lookup(addr string) (isoCode string, err error) {
 	host := addr
 	if strings.Contains(host, ":") {
 		if host, _, err = net.SplitHostPort(host); err != nil {
-			log.Print("SplitHostPort:", host, err)
-			return true
+			return
 		}
 	}
 
 	// 解析域名为IP地址
-	ip, ok := dnsCache.Query(host)
+	ip, ok := Resolve(host)
 	if !ok {
-		return true
-	}
-
-	// 判断是否局域网ip
-	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalMulticast() || ip.IsLinkLocalUnicast() {
-		return true
-	}
-
-	// 查询IP地址的归属地
-	record, err := geoipDB.Country(ip)
-	if err != nil {
-		log.Printf("geoip search country error: %s", err)
-		return true
+		err = fmt.Errorf("geoip: resolve %s failed", host)
+		return
 	}
 
-	// 判断归属地是否是中国
-	if record.Country.IsoCode == "CN" {
-		return true
+	if IsPrivate(ip) {
+		isoCode = LAN
+		return
 	}
 
-	return false
+	return Country(ip)
 }
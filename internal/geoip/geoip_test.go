@@ -0,0 +1,145 @@
+package geoip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testDB = []byte("not really an mmdb, download does not parse it")
+
+func newDownloadServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/geoip.mmdb":
+			w.Write(testDB)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// 目录中只应该有 want 列出的文件, 临时文件必须被清理
+func checkDir(t *testing.T, dir string, want ...string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, v := range entries {
+		names = append(names, v.Name())
+	}
+
+	if len(names) != len(want) {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	for k := range names {
+		if names[k] != want[k] {
+			t.Fatalf("files = %v, want %v", names, want)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	srv := newDownloadServer(t)
+	sum := sha256.Sum256(testDB)
+
+	for _, tt := range []struct {
+		name string
+		sum  string
+	}{
+		{"no checksum", ""},
+		{"checksum", hex.EncodeToString(sum[:])},
+		{"checksum uppercase", strings.ToUpper(hex.EncodeToString(sum[:]))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "geoip.mmdb")
+
+			if err := Download(srv.URL+"/geoip.mmdb", path, tt.sum); err != nil {
+				t.Fatalf("Download: %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(testDB) {
+				t.Fatalf("content = %q, want %q", data, testDB)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := fi.Mode().Perm(); mode != 0644 {
+				t.Fatalf("mode = %v, want 0644", mode)
+			}
+
+			checkDir(t, dir, "geoip.mmdb")
+		})
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	srv := newDownloadServer(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "geoip.mmdb")
+
+	err := Download(srv.URL+"/geoip.mmdb", path, hex.EncodeToString(make([]byte, sha256.Size)))
+	if err == nil {
+		t.Fatal("Download succeeded with a wrong checksum")
+	}
+
+	checkDir(t, dir)
+}
+
+func TestDownloadChecksumMismatchKeepsOldFile(t *testing.T) {
+	srv := newDownloadServer(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "geoip.mmdb")
+
+	old := []byte("old database")
+	if err := os.WriteFile(path, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Download(srv.URL+"/geoip.mmdb", path, "deadbeef"); err == nil {
+		t.Fatal("Download succeeded with a wrong checksum")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(old) {
+		t.Fatalf("content = %q, want the old database", data)
+	}
+
+	checkDir(t, dir, "geoip.mmdb")
+}
+
+func TestDownloadBadStatus(t *testing.T) {
+	srv := newDownloadServer(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "geoip.mmdb")
+
+	if err := Download(srv.URL+"/missing.mmdb", path, ""); err == nil {
+		t.Fatal("Download succeeded on 404")
+	}
+
+	checkDir(t, dir)
+}
@@ -0,0 +1,181 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 没有 Content-Length 和 chunked 的响应, 响应体直到连接关闭
+const BodyUntilEOF = -1
+
+var ErrBadChunk = errors.New("http bad chunked encoding")
+
+// 根据 Transfer-Encoding 和 Content-Length 计算消息体长度, 格式错误时返回 kind
+// 多个相同的 Content-Length 合并为一个, 不同时按格式错误处理 (RFC 7230 3.3.2)
+func contentLength(h *Header, kind error) (n int64, chunked bool, err error) {
+	if te := h.Get("Transfer-Encoding"); len(te) > 0 {
+		// chunked 必须是最后一个编码
+		codings := strings.Split(te, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			err = malformed(kind, "transfer-encoding", te)
+			return
+		}
+
+		chunked = true
+		return
+	}
+
+	var cl string
+	for _, v := range *h {
+		if !strings.EqualFold(v.Key, "Content-Length") {
+			continue
+		}
+
+		for _, s := range strings.Split(v.Value, ",") {
+			s = strings.TrimSpace(s)
+			if !isDigits(s, 10) || (len(cl) > 0 && s != cl) {
+				err = malformed(kind, "content-length", v.Value)
+				return
+			}
+			cl = s
+		}
+	}
+
+	if len(cl) <= 0 {
+		return
+	}
+
+	if n, err = strconv.ParseInt(cl, 10, 64); err != nil {
+		n = 0
+		err = malformed(kind, "content-length", cl)
+		return
+	}
+
+	h.Set("Content-Length", cl)
+	return
+}
+
+// 只包含数字, strconv.ParseInt 还会接受正负号
+func isDigits(s string, base int) bool {
+	if len(s) <= 0 {
+		return false
+	}
+
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			continue
+		}
+		if base == 16 && ((c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// 请求体长度, 没有 Content-Length 和 chunked 时为 0
+func (req *HTTPRequest) ContentLength() (n int64, chunked bool, err error) {
+	return contentLength(&req.Header, ErrBadRequest)
+}
+
+func (req *HTTPRequest) KeepAlive() bool {
+	return keepAlive(req.Proto, req.Header) && !hasToken(req.Header, "Proxy-Connection", "close")
+}
+
+// HTTP/1.1 默认保持连接, HTTP/1.0 需要 keep-alive
+func keepAlive(proto string, h Header) bool {
+	if hasToken(h, "Connection", "close") {
+		return false
+	}
+
+	if proto == "HTTP/1.0" {
+		return hasToken(h, "Connection", "keep-alive") || hasToken(h, "Proxy-Connection", "keep-alive")
+	}
+
+	return true
+}
+
+// 逗号分隔的请求头中是否包含 token
+func hasToken(h Header, key, token string) bool {
+	for _, v := range h {
+		if !strings.EqualFold(v.Key, key) {
+			continue
+		}
+
+		for _, t := range strings.Split(v.Value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// 从缓冲区中原样复制消息体, n 为 BodyUntilEOF 时复制到连接关闭
+func (r *Reader) CopyBody(dst io.Writer, n int64, chunked bool) (err error) {
+	if chunked {
+		return r.copyChunked(dst)
+	}
+
+	if n == BodyUntilEOF {
+		_, err = io.Copy(dst, r.br)
+		return
+	}
+
+	_, err = io.CopyN(dst, r.br, n)
+	return
+}
+
+// chunk-size [; ext] CRLF data CRLF ... 0 CRLF trailer CRLF
+func (r *Reader) copyChunked(dst io.Writer) (err error) {
+	for {
+		var line []byte
+		if line, err = r.br.ReadSlice('\n'); err != nil {
+			return
+		}
+
+		size, _, _ := bytes.Cut(bytes.TrimSpace(line), []byte(";"))
+		hex := string(bytes.TrimSpace(size))
+		n, e := strconv.ParseInt(hex, 16, 64)
+		if e != nil || !isDigits(hex, 16) {
+			return fmt.Errorf("%w: %q", ErrBadChunk, line)
+		}
+
+		if _, err = dst.Write(line); err != nil {
+			return
+		}
+
+		if n == 0 {
+			return r.copyTrailer(dst)
+		}
+
+		// 数据和结尾的 CRLF
+		if _, err = io.CopyN(dst, r.br, n+2); err != nil {
+			return
+		}
+	}
+}
+
+// 复制 trailer 直到空行
+func (r *Reader) copyTrailer(dst io.Writer) (err error) {
+	for {
+		var line []byte
+		if line, err = r.br.ReadSlice('\n'); err != nil {
+			return
+		}
+
+		if _, err = dst.Write(line); err != nil {
+			return
+		}
+
+		if len(bytes.TrimSpace(line)) <= 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package http
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestContentLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  Header
+		n       int64
+		chunked bool
+		bad     bool
+	}{
+		{"none", Header{}, 0, false, false},
+		{"single", Header{{"Content-Length", "44"}}, 44, false, false},
+		{"same duplicates", Header{{"Content-Length", "44"}, {"content-length", "44"}}, 44, false, false},
+		{"same list", Header{{"Content-Length", "44, 44"}}, 44, false, false},
+		{"different duplicates", Header{{"Content-Length", "0"}, {"Content-Length", "44"}}, 0, false, true},
+		{"different list", Header{{"Content-Length", "0, 44"}}, 0, false, true},
+		{"plus sign", Header{{"Content-Length", "+5"}}, 0, false, true},
+		{"minus sign", Header{{"Content-Length", "-1"}}, 0, false, true},
+		{"empty", Header{{"Content-Length", ""}}, 0, false, true},
+		{"overflow", Header{{"Content-Length", "99999999999999999999"}}, 0, false, true},
+		{"chunked", Header{{"Transfer-Encoding", "chunked"}, {"Content-Length", "5"}}, 0, true, false},
+		{"chunked not last", Header{{"Transfer-Encoding", "chunked, gzip"}}, 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &HTTPRequest{Header: tt.header}
+			n, chunked, err := req.ContentLength()
+			if tt.bad {
+				if !errors.Is(err, ErrBadRequest) {
+					t.Fatalf("err = %v, want %v", err, ErrBadRequest)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if n != tt.n || chunked != tt.chunked {
+				t.Fatalf("got %d/%v, want %d/%v", n, chunked, tt.n, tt.chunked)
+			}
+		})
+	}
+}
+
+func TestContentLengthMergesDuplicates(t *testing.T) {
+	req := &HTTPRequest{Header: Header{{"Content-Length", "5"}, {"Host", "a"}, {"Content-Length", "5"}}}
+	if _, _, err := req.ContentLength(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (Header{{"Content-Length", "5"}, {"Host", "a"}}); len(req.Header) != len(want) || req.Header[0] != want[0] || req.Header[1] != want[1] {
+		t.Fatalf("header = %v, want %v", req.Header, want)
+	}
+}
@@ -0,0 +1,28 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"strings"
+)
+
+// 代理出错时回复客户端, host 和 action 为失败的目标和路由, 可以为空
+// 具体的错误可能包含 ssh 上游等内部信息, 只记录在日志中, 不回复给客户端
+// 回复后连接需要关闭
+func ErrorReply(w io.Writer, code int, host, action string) (err error) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "%d %s\n\n", code, nethttp.StatusText(code))
+	if len(host) > 0 {
+		fmt.Fprintf(&body, "target: %s\n", host)
+	}
+	if len(action) > 0 {
+		fmt.Fprintf(&body, "route: %s\n", action)
+	}
+
+	_, err = fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s", code, nethttp.StatusText(code), body.Len(), body.String())
+	return
+}
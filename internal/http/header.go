@@ -0,0 +1,128 @@
+package http
+
+import (
+	"strings"
+)
+
+type HeaderField struct {
+	Key   string
+	Value string
+}
+
+// 按原始顺序和大小写保存的请求头, 查找时不区分大小写
+type Header []HeaderField
+
+func (h Header) Get(key string) string {
+	for _, v := range h {
+		if strings.EqualFold(v.Key, key) {
+			return v.Value
+		}
+	}
+
+	return ""
+}
+
+func (h Header) Has(key string) bool {
+	for _, v := range h {
+		if strings.EqualFold(v.Key, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Header) Add(key, value string) {
+	*h = append(*h, HeaderField{Key: key, Value: value})
+}
+
+// 替换第一个同名请求头并删除其余的, 不存在时追加
+func (h *Header) Set(key, value string) {
+	found := false
+	kept := (*h)[:0]
+	for _, v := range *h {
+		if strings.EqualFold(v.Key, key) {
+			if found {
+				continue
+			}
+
+			found = true
+			v.Value = value
+		}
+		kept = append(kept, v)
+	}
+
+	*h = kept
+	if !found {
+		h.Add(key, value)
+	}
+}
+
+func (h *Header) Del(key string) {
+	kept := (*h)[:0]
+	for _, v := range *h {
+		if !strings.EqualFold(v.Key, key) {
+			kept = append(kept, v)
+		}
+	}
+
+	*h = kept
+}
+
+// 追加到已有的逗号分隔列表, 不存在时新增
+func (h *Header) Append(key, value string) {
+	for k, v := range *h {
+		if strings.EqualFold(v.Key, key) {
+			(*h)[k].Value = v.Value + ", " + value
+			return
+		}
+	}
+
+	h.Add(key, value)
+}
+
+// 逐跳头部 (RFC 7230 6.1), Transfer-Encoding 和 Trailer 不在其中, 消息体按原样转发
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Upgrade",
+}
+
+// 删除逐跳头部及 Connection 中列出的头部, 协议升级时保留 Connection: Upgrade 和 Upgrade
+func (h *Header) RemoveHopByHop() {
+	upgrade := h.Get("Upgrade")
+	upgrading := len(upgrade) > 0 && hasToken(*h, "Connection", "upgrade")
+
+	var listed []string
+	for _, v := range *h {
+		if !strings.EqualFold(v.Key, "Connection") {
+			continue
+		}
+
+		for _, t := range strings.Split(v.Value, ",") {
+			t = strings.TrimSpace(t)
+			// 不能删除决定消息长度的头部
+			if strings.EqualFold(t, "Transfer-Encoding") || strings.EqualFold(t, "Content-Length") {
+				continue
+			}
+			listed = append(listed, t)
+		}
+	}
+
+	for _, k := range listed {
+		h.Del(k)
+	}
+
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+
+	if upgrading {
+		h.Add("Connection", "Upgrade")
+		h.Add("Upgrade", upgrade)
+	}
+}
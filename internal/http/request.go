@@ -1,10 +1,15 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"net/textproto"
 	"net/url"
 	"strings"
 	"time"
@@ -17,74 +22,187 @@ func CloseConn(conn *net.Conn) {
 	}
 }
 
+const DEFAULT_MAX_HEADER_SIZE = 64 * 1024
+
+var (
+	ErrHeaderTooLarge = errors.New("http request header too large")
+	ErrBadRequest     = errors.New("http bad request")
+	ErrBadResponse    = errors.New("http bad response")
+	// 上游的响应头超长, 与 ErrHeaderTooLarge 区分, 避免回复客户端 431
+	ErrResponseHeaderTooLarge = errors.New("http response header too large")
+)
+
 type HTTPRequest struct {
-	HeadBuf   []byte
-	conn      *net.Conn
-	Host      string
-	Method    string
-	URL       string
-	hostOrURL string
+	Method string
+	// 请求行中的原始目标, 可能是 origin-form, absolute-form 或 authority-form
+	RequestURI string
+	Proto      string
+	Header     Header
+	// 目标地址 host:port
+	Host string
+	// 完整 URL, CONNECT 请求为空
+	URL string
+	// 读取请求头时已经读到的后续数据
+	Body []byte
+
+	conn *net.Conn
+}
+
+// 从连接中依次读取请求或响应, 头部 (含首行) 超过 MaxHeaderSize 时返回 ErrHeaderTooLarge
+type Reader struct {
+	MaxHeaderSize int
+
+	conn *net.Conn
+	lr   *io.LimitedReader
+	br   *bufio.Reader
+	tp   *textproto.Reader
 }
 
-func NewHTTPRequest(inConn *net.Conn, bufSize int) (req HTTPRequest, err error) {
-	buf := make([]byte, bufSize)
-	len := 0
-	req = HTTPRequest{
-		conn: inConn,
+func NewReader(inConn *net.Conn, maxHeaderSize int) *Reader {
+	if maxHeaderSize <= 0 {
+		maxHeaderSize = DEFAULT_MAX_HEADER_SIZE
 	}
-	len, err = (*inConn).Read(buf[:])
-	if err != nil {
-		if err != io.EOF {
-			err = fmt.Errorf("http decoder read err:%s", err)
+
+	r := &Reader{
+		MaxHeaderSize: maxHeaderSize,
+		conn:          inConn,
+		lr:            &io.LimitedReader{R: *inConn, N: math.MaxInt64},
+	}
+	r.br = bufio.NewReader(r.lr)
+	r.tp = textproto.NewReader(r.br)
+
+	return r
+}
+
+// 读取一个请求的请求行和请求头, 请求体留在缓冲区中
+func (r *Reader) ReadRequest() (req *HTTPRequest, err error) {
+	defer r.limitHeader(ErrHeaderTooLarge)(&err)
+
+	// 忽略请求行之前的空行 (RFC 7230 3.5)
+	var line string
+	for len(line) <= 0 {
+		if line, err = r.tp.ReadLine(); err != nil {
+			return
 		}
-		CloseConn(inConn)
+	}
+
+	req = &HTTPRequest{
+		conn: r.conn,
+	}
+
+	method, rest, ok1 := strings.Cut(line, " ")
+	target, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || len(method) <= 0 || len(target) <= 0 || !strings.HasPrefix(proto, "HTTP/") {
+		err = malformed(ErrBadRequest, "request line", line)
 		return
 	}
-	req.HeadBuf = buf[:len]
-	index := bytes.IndexByte(req.HeadBuf, '\n')
-	if index == -1 {
-		if len > 50 {
-			len = 50
-		}
 
-		err = fmt.Errorf("http decoder data line err:%s", string(req.HeadBuf)[:len])
-		CloseConn(inConn)
+	req.Method = strings.ToUpper(method)
+	req.RequestURI = target
+	req.Proto = proto
+
+	if req.Header, err = r.readHeader(ErrBadRequest); err != nil {
 		return
 	}
-	fmt.Sscanf(string(req.HeadBuf[:index]), "%s%s", &req.Method, &req.hostOrURL)
-	if req.Method == "" || req.hostOrURL == "" {
-		if len > 50 {
-			len = 50
+
+	err = req.resolveTarget()
+	return
+}
+
+// 读取头部期间限制长度, 返回的函数在读取结束后调用, 恢复限制并把超长错误转换为 tooLarge
+func (r *Reader) limitHeader(tooLarge error) func(err *error) {
+	r.lr.N = int64(r.MaxHeaderSize)
+
+	return func(err *error) {
+		if r.lr.N <= 0 && *err != nil {
+			*err = tooLarge
 		}
-		err = fmt.Errorf("http decoder data err:%s", string(req.HeadBuf)[:len])
-		CloseConn(inConn)
-		return
+		r.lr.N = math.MaxInt64
 	}
-	req.Method = strings.ToUpper(req.Method)
-	// log.Printf("%s:%s", req.Method, req.hostOrURL)
+}
+
+// 读取头部字段直到空行, 格式错误时返回 kind
+func (r *Reader) readHeader(kind error) (h Header, err error) {
+	for {
+		var kv string
+		if kv, err = r.tp.ReadContinuedLine(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
 
-	if req.IsHTTPS() {
-		err = req.HTTPS()
-	} else {
-		err = req.HTTP()
+		if len(kv) <= 0 {
+			return
+		}
+
+		k, v, found := strings.Cut(kv, ":")
+		if !found || len(k) <= 0 || strings.ContainsAny(k, " \t") {
+			err = malformed(kind, "header", kv)
+			return
+		}
+
+		h.Add(k, strings.TrimSpace(v))
 	}
-	return
 }
 
-func (req *HTTPRequest) HTTP() (err error) {
-	req.URL, err = req.getHTTPURL()
-	if err == nil {
-		u, _ := url.Parse(req.URL)
-		req.Host = u.Host
-		req.addPortIfNot()
+// 取出缓冲区中已读取的数据, 之后可以直接读取连接
+func (r *Reader) Buffered() []byte {
+	n := r.br.Buffered()
+	if n <= 0 {
+		return nil
 	}
+
+	b, _ := r.br.Peek(n)
+	b = append([]byte(nil), b...)
+	r.br.Discard(n)
+
+	return b
+}
+
+func malformed(kind error, what, data string) error {
+	if len(data) > 50 {
+		data = data[:50]
+	}
+
+	return fmt.Errorf("%w: invalid %s %q", kind, what, data)
+}
+
+// 读取一个请求, 请求头之后已读取的数据保存在 Body 中
+func NewHTTPRequest(inConn *net.Conn, maxHeaderSize int) (req *HTTPRequest, err error) {
+	r := NewReader(inConn, maxHeaderSize)
+	if req, err = r.ReadRequest(); err != nil {
+		return
+	}
+
+	req.Body = r.Buffered()
 	return
 }
 
-func (req *HTTPRequest) HTTPS() (err error) {
-	req.Host = req.hostOrURL
+// 根据请求目标计算 Host 和 URL
+func (req *HTTPRequest) resolveTarget() (err error) {
+	switch {
+	case req.IsHTTPS():
+		req.Host = req.RequestURI
+	case strings.HasPrefix(req.RequestURI, "/") || req.RequestURI == "*":
+		host := req.Header.Get("Host")
+		if len(host) <= 0 {
+			return malformed(ErrBadRequest, "host", host)
+		}
+
+		req.URL = "http://" + host + req.RequestURI
+		req.Host = host
+	default:
+		u, e := url.Parse(req.RequestURI)
+		if e != nil || len(u.Host) <= 0 {
+			return malformed(ErrBadRequest, "url", req.RequestURI)
+		}
+
+		req.URL = req.RequestURI
+		req.Host = u.Host
+	}
+
 	req.addPortIfNot()
-	//_, err = fmt.Fprint(*req.conn, "HTTP/1.1 200 Connection established\r\n\r\n")
 	return
 }
 
@@ -97,40 +215,78 @@ func (req *HTTPRequest) IsHTTPS() bool {
 	return req.Method == "CONNECT"
 }
 
-func (req *HTTPRequest) getHTTPURL() (URL string, err error) {
-	if !strings.HasPrefix(req.hostOrURL, "/") {
-		return req.hostOrURL, nil
+// 转换为 origin-form, 直接发送给目标服务器时使用
+func (req *HTTPRequest) ToOriginForm() {
+	if len(req.URL) <= 0 || strings.HasPrefix(req.RequestURI, "/") {
+		return
 	}
-	_host, err := req.getHeader("host")
+
+	u, err := url.Parse(req.URL)
 	if err != nil {
 		return
 	}
-	URL = fmt.Sprintf("http://%s%s", _host, req.hostOrURL)
-	return
+
+	// RFC 7230 5.4: Host 必须与请求目标一致, 不能使用客户端发送的值
+	req.RequestURI = u.RequestURI()
+	req.Header.Set("Host", u.Host)
 }
 
-func (req *HTTPRequest) getHeader(key string) (val string, err error) {
-	key = strings.ToUpper(key)
-	lines := strings.Split(string(req.HeadBuf), "\r\n")
-	for _, line := range lines {
-		line := strings.SplitN(strings.Trim(line, "\r\n "), ":", 2)
-		if len(line) == 2 {
-			k := strings.ToUpper(strings.Trim(line[0], " "))
-			v := strings.Trim(line[1], " ")
-			if key == k {
-				val = v
-				return
-			}
-		}
+// 转换为 absolute-form, 发送给上级 http 代理时使用
+func (req *HTTPRequest) ToAbsoluteForm() {
+	if len(req.URL) <= 0 {
+		return
+	}
+
+	req.RequestURI = req.URL
+}
+
+// 序列化请求行和请求头, 后接已读取的数据
+func (req *HTTPRequest) Bytes() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s %s\r\n", req.Method, req.RequestURI, req.Proto)
+	for _, v := range req.Header {
+		fmt.Fprintf(&b, "%s: %s\r\n", v.Key, v.Value)
 	}
-	err = fmt.Errorf("can not find HOST header")
+	b.WriteString("\r\n")
+	b.Write(req.Body)
+
+	return b.Bytes()
+}
+
+// 解析 Proxy-Authorization: Basic 凭据
+func (req *HTTPRequest) ProxyAuth() (username, password string, ok bool) {
+	val := req.Header.Get("Proxy-Authorization")
+	if len(val) <= 0 {
+		return
+	}
+
+	scheme, encoded, found := strings.Cut(val, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return
+	}
+
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return
+}
+
+// 回复 407, 要求客户端提供代理认证
+func (req *HTTPRequest) ProxyAuthRequired(realm string) (err error) {
+	_, err = fmt.Fprintf(*req.conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+		"Proxy-Authenticate: Basic realm=%q\r\n"+
+		"Content-Length: 0\r\n"+
+		"Connection: close\r\n\r\n", realm)
 	return
 }
 
 func (req *HTTPRequest) addPortIfNot() (newHost string) {
 	//newHost = req.Host
 	port := "80"
-	if req.IsHTTPS() {
+	if req.IsHTTPS() || strings.HasPrefix(strings.ToLower(req.URL), "https://") {
 		port = "443"
 	}
 
@@ -142,3 +298,35 @@ func (req *HTTPRequest) addPortIfNot() (newHost string) {
 	}
 	return
 }
+
+// 通过 http 代理建立到 address 的隧道
+func Connect(conn net.Conn, address string) (err error) {
+	if _, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address); err != nil {
+		return
+	}
+
+	// 逐字节读取响应头, 避免读走隧道中的数据
+	head := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= 4096 {
+			err = fmt.Errorf("http connect %s: response header too large", address)
+			return
+		}
+
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return
+		}
+		head = append(head, b[0])
+	}
+
+	var proto string
+	var code int
+	fmt.Sscanf(string(head), "%s%d", &proto, &code)
+	if code != 200 {
+		line, _, _ := strings.Cut(string(head), "\r\n")
+		err = fmt.Errorf("http connect %s: %s", address, line)
+	}
+
+	return
+}
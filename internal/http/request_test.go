@@ -0,0 +1,54 @@
+package http
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func readRequest(t *testing.T, raw string) *HTTPRequest {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte(raw))
+
+	req, err := NewReader(&server, 0).ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+
+	return req
+}
+
+func TestToOriginFormReplacesHost(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		uri  string
+		host string
+	}{
+		{"mismatched host", "GET http://a.example/x?y=1 HTTP/1.1\r\nHost: evil.example\r\n\r\n", "/x?y=1", "a.example"},
+		{"missing host", "GET http://a.example:8080/ HTTP/1.1\r\n\r\n", "/", "a.example:8080"},
+		{"origin-form", "GET /x HTTP/1.1\r\nHost: b.example\r\n\r\n", "/x", "b.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := readRequest(t, tt.raw)
+			req.ToOriginForm()
+
+			if req.RequestURI != tt.uri {
+				t.Fatalf("RequestURI = %q, want %q", req.RequestURI, tt.uri)
+			}
+			if host := req.Header.Get("Host"); host != tt.host {
+				t.Fatalf("Host = %q, want %q", host, tt.host)
+			}
+			if n := strings.Count(strings.ToLower(string(req.Bytes())), "\r\nhost:"); n != 1 {
+				t.Fatalf("%d Host headers, want 1", n)
+			}
+		})
+	}
+}
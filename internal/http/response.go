@@ -0,0 +1,77 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Response struct {
+	Proto      string
+	StatusCode int
+	// 状态码之后的原因短语
+	Reason string
+	Header Header
+}
+
+// 读取响应的状态行和响应头, 响应体留在缓冲区中
+func (r *Reader) ReadResponse() (resp *Response, err error) {
+	defer r.limitHeader(ErrResponseHeaderTooLarge)(&err)
+
+	line, err := r.tp.ReadLine()
+	if err != nil {
+		return
+	}
+
+	proto, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	if !strings.HasPrefix(proto, "HTTP/") || len(code) != 3 {
+		err = malformed(ErrBadResponse, "status line", line)
+		return
+	}
+
+	resp = &Response{
+		Proto:  proto,
+		Reason: reason,
+	}
+
+	if resp.StatusCode, err = strconv.Atoi(code); err != nil {
+		err = malformed(ErrBadResponse, "status line", line)
+		return
+	}
+
+	resp.Header, err = r.readHeader(ErrBadResponse)
+	return
+}
+
+// 序列化状态行和响应头
+func (resp *Response) Bytes() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %03d %s\r\n", resp.Proto, resp.StatusCode, resp.Reason)
+	for _, v := range resp.Header {
+		fmt.Fprintf(&b, "%s: %s\r\n", v.Key, v.Value)
+	}
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+// 响应体长度, method 为对应请求的方法
+func (resp *Response) ContentLength(method string) (n int64, chunked bool, err error) {
+	// RFC 7230 3.3.3: HEAD, 1xx, 204, 304 没有响应体
+	if method == "HEAD" || resp.StatusCode/100 == 1 || resp.StatusCode == 204 || resp.StatusCode == 304 {
+		return
+	}
+
+	n, chunked, err = contentLength(&resp.Header, ErrBadResponse)
+	if err == nil && !chunked && !resp.Header.Has("Content-Length") {
+		n = BodyUntilEOF
+	}
+
+	return
+}
+
+func (resp *Response) KeepAlive() bool {
+	return keepAlive(resp.Proto, resp.Header)
+}
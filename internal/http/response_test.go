@@ -0,0 +1,43 @@
+package http
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHeaderTooLarge(t *testing.T) {
+	big := "X-Big: " + strings.Repeat("a", 2048) + "\r\n\r\n"
+
+	tests := []struct {
+		name string
+		raw  string
+		read func(r *Reader) error
+		want error
+	}{
+		{"request", "GET / HTTP/1.1\r\nHost: a\r\n" + big, func(r *Reader) (err error) {
+			_, err = r.ReadRequest()
+			return
+		}, ErrHeaderTooLarge},
+		{"response", "HTTP/1.1 200 OK\r\n" + big, func(r *Reader) (err error) {
+			_, err = r.ReadResponse()
+			return
+		}, ErrResponseHeaderTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go client.Write([]byte(tt.raw))
+
+			err := tt.read(NewReader(&server, 1024))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
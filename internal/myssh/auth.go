@@ -0,0 +1,218 @@
+package myssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/taodev/goway/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	AuthPublicKey           = "publickey"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+	AuthAgent               = "agent"
+)
+
+// 根据配置生成认证方式, 按 Auth 中的顺序尝试, 未配置时只使用私钥认证
+// 返回的 closer 需要在握手结束后调用, 用于关闭 ssh-agent 连接
+func authMethods(opts config.SSHConfig) (methods []ssh.AuthMethod, closer func(), err error) {
+	auth := opts.Auth
+	if len(auth) <= 0 {
+		auth = []string{AuthPublicKey}
+	}
+
+	var conns []net.Conn
+	closer = func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			closer()
+		}
+	}()
+
+	// publickey 和 agent 的方法名都是 publickey, ssh 客户端不会重复尝试同名的方法
+	// 因此合并为一个方法, 放在第一次出现的位置, 按配置顺序提供私钥文件和 agent 中的密钥
+	var keys []func() ([]ssh.Signer, error)
+	addKeys := func(fn func() ([]ssh.Signer, error)) {
+		if len(keys) <= 0 {
+			methods = append(methods, ssh.PublicKeysCallback(func() (signers []ssh.Signer, err error) {
+				for _, v := range keys {
+					s, e := v()
+					if e != nil {
+						err = e
+						continue
+					}
+					signers = append(signers, s...)
+				}
+
+				// 部分来源失败时仍然尝试其他来源的密钥
+				if len(signers) > 0 {
+					err = nil
+				}
+				return
+			}))
+		}
+		keys = append(keys, fn)
+	}
+
+	for _, v := range auth {
+		switch v {
+		case AuthPublicKey:
+			var signers []ssh.Signer
+			if signers, err = loadSigners(opts); err != nil {
+				return
+			}
+			addKeys(func() ([]ssh.Signer, error) {
+				return signers, nil
+			})
+		case AuthPassword:
+			var password string
+			if password, err = loadPassword(opts); err != nil {
+				return
+			}
+			methods = append(methods, ssh.Password(password))
+		case AuthKeyboardInteractive:
+			var password string
+			if password, err = loadPassword(opts); err != nil {
+				return
+			}
+			methods = append(methods, ssh.KeyboardInteractive(
+				func(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
+					// 所有问题都用密码回答
+					answers = make([]string, len(questions))
+					for i := range answers {
+						answers[i] = password
+					}
+					return
+				}))
+		case AuthAgent:
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if len(sock) <= 0 {
+				err = errors.New("ssh: agent auth requires SSH_AUTH_SOCK")
+				return
+			}
+
+			var conn net.Conn
+			if conn, err = net.Dial("unix", sock); err != nil {
+				return
+			}
+			conns = append(conns, conn)
+			addKeys(agent.NewClient(conn).Signers)
+		default:
+			err = fmt.Errorf("ssh: unknown auth method %q", v)
+			return
+		}
+	}
+
+	return
+}
+
+// 读取私钥, 私钥加密时使用配置的密码解密, 存在证书时一并使用证书认证
+func loadSigners(opts config.SSHConfig) (signers []ssh.Signer, err error) {
+	pemFile, err := os.ReadFile(opts.IdentityFile)
+	if err != nil {
+		return
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemFile)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		var passphrase string
+		if passphrase, err = loadPassphrase(opts); err != nil {
+			return
+		}
+
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemFile, []byte(passphrase))
+	}
+	if err != nil {
+		err = fmt.Errorf("ssh: parse %s: %w", opts.IdentityFile, err)
+		return
+	}
+
+	certFile := opts.CertificateFile
+	if len(certFile) <= 0 && fileExists(opts.IdentityFile+"-cert.pub") {
+		certFile = opts.IdentityFile + "-cert.pub"
+	}
+
+	if len(certFile) > 0 {
+		var certSigner ssh.Signer
+		if certSigner, err = loadCertSigner(certFile, signer); err != nil {
+			return
+		}
+		signers = append(signers, certSigner)
+	}
+
+	signers = append(signers, signer)
+	return
+}
+
+func loadCertSigner(path string, signer ssh.Signer) (certSigner ssh.Signer, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		err = fmt.Errorf("ssh: parse %s: %w", path, err)
+		return
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		err = fmt.Errorf("ssh: %s is not a certificate", path)
+		return
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+func loadPassword(opts config.SSHConfig) (password string, err error) {
+	return loadSecret("password", opts.Password, opts.PasswordEnv, opts.PasswordFile)
+}
+
+func loadPassphrase(opts config.SSHConfig) (passphrase string, err error) {
+	return loadSecret("passphrase", opts.Passphrase, opts.PassphraseEnv, opts.PassphraseFile)
+}
+
+// 依次从配置值, 环境变量, 文件中读取
+func loadSecret(name, value, env, file string) (secret string, err error) {
+	if len(value) > 0 {
+		secret = value
+		return
+	}
+
+	if len(env) > 0 {
+		if v, ok := os.LookupEnv(env); ok {
+			secret = v
+			return
+		}
+	}
+
+	if len(file) > 0 {
+		var data []byte
+		if data, err = os.ReadFile(file); err != nil {
+			return
+		}
+		secret = strings.TrimRight(string(data), "\r\n")
+		return
+	}
+
+	err = fmt.Errorf("ssh: %s not configured", name)
+	return
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
@@ -0,0 +1,178 @@
+package myssh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/taodev/goway/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// 把私钥写入 identity_file
+func writeIdentityFile(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id_test")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// 启动一个只包含 key 的 ssh-agent, 并设置 SSH_AUTH_SOCK
+func startTestAgent(t *testing.T, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", sock)
+}
+
+// 在本地完成 ssh 握手, 服务端只接受 allowed 公钥
+func handshake(t *testing.T, methods []ssh.AuthMethod, allowed ssh.PublicKey) error {
+	t.Helper()
+
+	hostKey, err := ssh.NewSignerFromKey(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), allowed.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("key not allowed")
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		server, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+
+		if conn, _, _, err := ssh.NewServerConn(server, serverConfig); err == nil {
+			conn.Close()
+		}
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, _, _, err := ssh.NewClientConn(client, "pipe", &ssh.ClientConfig{
+		User:            "goway",
+		Auth:            methods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		conn.Close()
+	}
+
+	return err
+}
+
+func TestAuthMethodsPublicKeyAndAgent(t *testing.T) {
+	fileKey := newTestKey(t)
+	agentKey := newTestKey(t)
+
+	identityFile := writeIdentityFile(t, fileKey)
+	startTestAgent(t, agentKey)
+
+	publicKey := func(key *ecdsa.PrivateKey) ssh.PublicKey {
+		pub, err := ssh.NewPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pub
+	}
+
+	tests := []struct {
+		name    string
+		auth    []string
+		allowed *ecdsa.PrivateKey
+	}{
+		{"publickey then agent, agent key", []string{AuthPublicKey, AuthAgent}, agentKey},
+		{"publickey then agent, file key", []string{AuthPublicKey, AuthAgent}, fileKey},
+		{"agent then publickey, file key", []string{AuthAgent, AuthPublicKey}, fileKey},
+		{"agent then publickey, agent key", []string{AuthAgent, AuthPublicKey}, agentKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methods, closer, err := authMethods(config.SSHConfig{
+				IdentityFile: identityFile,
+				Auth:         tt.auth,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer()
+
+			if err = handshake(t, methods, publicKey(tt.allowed)); err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+		})
+	}
+}
@@ -2,15 +2,17 @@ package myssh
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/url"
-	"os"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/taodev/goway/config"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -23,6 +25,10 @@ var (
 type SSHConn struct {
 	net.Conn
 	IsLocal bool
+
+	// 所属的 ssh 客户端, 关闭时减少其通道计数
+	client    *SSHClient
+	closeOnce sync.Once
 }
 
 func (c *SSHConn) Read(b []byte) (n int, err error) {
@@ -36,19 +42,63 @@ func (c *SSHConn) Write(b []byte) (n int, err error) {
 }
 
 func (c *SSHConn) Close() error {
+	if c.client != nil {
+		c.closeOnce.Do(func() {
+			atomic.AddInt32(&c.client.channels, -1)
+		})
+	}
+
 	c.SetDeadline(time.Now().Add(DEFAULT_TIMEOUT))
 	return c.Conn.Close()
 }
 
+// 远程转发的监听端口, 服务器返回的地址为 0.0.0.0 时替换为 ssh 服务器的地址
+type SSHListener struct {
+	net.Listener
+
+	client *SSHClient
+	addr   net.Addr
+}
+
+func (l *SSHListener) Accept() (c net.Conn, err error) {
+	if c, err = l.Listener.Accept(); err != nil {
+		return
+	}
+
+	atomic.AddInt32(&l.client.channels, 1)
+	c = &SSHConn{
+		Conn:   c,
+		client: l.client,
+	}
+
+	return
+}
+
+func (l *SSHListener) Addr() net.Addr {
+	return l.addr
+}
+
 type SSHClient struct {
 	Addr    string
 	User    string
 	KeyFile string
+	Options config.SSHConfig
 
 	c *ssh.Client
+	// 跳板机连接, 按连接顺序保存
+	hops []*ssh.Client
 
 	closeOnce *sync.Once
 
+	// 当前打开的通道数
+	channels int32
+	// keepalive 往返时间 (纳秒), 平滑后的值
+	rtt int64
+
+	state       int32
+	subscribers []func(State)
+	subLocker   sync.Mutex
+
 	chDial     chan int
 	chShutdown chan int
 
@@ -62,19 +112,74 @@ func (cli *SSHClient) Dial(n string, addr string) (c net.Conn, err error) {
 		return
 	}
 
-	c, err = cli.c.Dial(n, addr)
-	if err == io.EOF {
-		log.Println("[ERROR] ssh: connect failed")
-		cli.chDial <- 0
+	cli.locker.RLock()
+	sc := cli.c
+	cli.locker.RUnlock()
+
+	if sc == nil {
+		err = ErrNotValid
+		return
 	}
 
+	c, err = sc.Dial(n, addr)
+	if err != nil {
+		if err == io.EOF {
+			log.Println("[ERROR] ssh: connect failed")
+			cli.Reconnect()
+		}
+		return
+	}
+
+	atomic.AddInt32(&cli.channels, 1)
 	c = &SSHConn{
-		Conn: c,
+		Conn:   c,
+		client: cli,
+	}
+
+	return
+}
+
+// 在 ssh 服务器上监听 (remote forwarding), 需要服务器开启 GatewayPorts 才能从外部访问
+func (cli *SSHClient) Listen(n string, addr string) (l net.Listener, err error) {
+	cli.locker.RLock()
+	sc := cli.c
+	cli.locker.RUnlock()
+
+	if sc == nil {
+		err = ErrNotValid
+		return
+	}
+
+	ln, err := sc.Listen(n, addr)
+	if err != nil {
+		if err == io.EOF {
+			log.Println("[ERROR] ssh: listen failed")
+			cli.Reconnect()
+		}
+		return
+	}
+
+	bindAddr := ln.Addr()
+	if tcpAddr, ok := bindAddr.(*net.TCPAddr); ok && tcpAddr.IP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(cli.Addr)
+		if ip, e := net.ResolveIPAddr("ip", host); e == nil {
+			bindAddr = &net.TCPAddr{IP: ip.IP, Port: tcpAddr.Port}
+		}
+	}
+
+	l = &SSHListener{
+		Listener: ln,
+		client:   cli,
+		addr:     bindAddr,
 	}
 
 	return
 }
 
+func (cli *SSHClient) Channels() int32 {
+	return atomic.LoadInt32(&cli.channels)
+}
+
 func (cli *SSHClient) Close() {
 	if !cli.IsValid() {
 		return
@@ -92,12 +197,21 @@ func (cli *SSHClient) Close() {
 
 		cli.c.Close()
 		cli.c = nil
-		cli.chDial = nil
+		closeHops(cli.hops)
+		cli.hops = nil
 	})
 }
 
+// 通知 keeplive 检查连接, 不会阻塞调用方
+func (cli *SSHClient) Reconnect() {
+	select {
+	case cli.chDial <- 0:
+	default:
+	}
+}
+
 func (cli *SSHClient) Shutdown() {
-	cli.chShutdown <- 0
+	close(cli.chShutdown)
 	cli.wg.Wait()
 	cli.Close()
 }
@@ -109,15 +223,40 @@ func (cli *SSHClient) Ping() (err error) {
 		}
 	}()
 
-	if cli.c == nil {
+	cli.locker.RLock()
+	sc := cli.c
+	cli.locker.RUnlock()
+
+	if sc == nil {
 		err = ErrNotValid
 		return
 	}
 
-	_, _, err = cli.c.SendRequest("keepalive@ssh-tunnel", true, nil)
+	start := time.Now()
+	if _, _, err = sc.SendRequest("keepalive@ssh-tunnel", true, nil); err != nil {
+		return
+	}
+
+	cli.updateRTT(time.Since(start))
 	return
 }
 
+// 指数加权平均, 避免单次抖动
+func (cli *SSHClient) updateRTT(sample time.Duration) {
+	old := atomic.LoadInt64(&cli.rtt)
+	if old == 0 {
+		atomic.StoreInt64(&cli.rtt, int64(sample))
+		return
+	}
+
+	atomic.StoreInt64(&cli.rtt, (old*7+int64(sample))/8)
+}
+
+// 最近的 keepalive 往返时间, 未测量时为 0
+func (cli *SSHClient) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cli.rtt))
+}
+
 func (cli *SSHClient) IsValid() bool {
 	cli.locker.RLock()
 	defer cli.locker.RUnlock()
@@ -125,104 +264,141 @@ func (cli *SSHClient) IsValid() bool {
 	return cli.c != nil
 }
 
+// 依次连接跳板机, 最后通过跳板机连接目标服务器
 func (cli *SSHClient) dial() (err error) {
-	pemFile, err := os.ReadFile(cli.KeyFile)
+	var hops []*ssh.Client
+	defer func() {
+		if err != nil {
+			closeHops(hops)
+		}
+	}()
+
+	var c *ssh.Client
+	for _, v := range cli.Options.Jump {
+		if c, err = dialHop(c, v); err != nil {
+			err = fmt.Errorf("ssh: jump %s: %w", v.URL, err)
+			return
+		}
+		hops = append(hops, c)
+	}
+
+	if c, err = dialHop(c, cli.Options); err != nil {
+		return
+	}
+
+	cli.locker.Lock()
+	cli.c = c
+	cli.hops = hops
+	cli.closeOnce = new(sync.Once)
+	cli.locker.Unlock()
+
+	return
+}
+
+// 连接一台 ssh 服务器, via 不为空时通过 via 转发
+func dialHop(via *ssh.Client, opts config.SSHConfig) (c *ssh.Client, err error) {
+	addr, user, err := parseURL(opts.URL)
 	if err != nil {
 		return
 	}
 
-	signer, err := ssh.ParsePrivateKey(pemFile)
+	auth, closeAuth, err := authMethods(opts)
 	if err != nil {
 		log.Printf("ssh: %v", err)
 		return
 	}
+	defer closeAuth()
+
+	checkHostKey, err := hostKeyCallback(opts)
+	if err != nil {
+		return
+	}
 
 	conf := &ssh.ClientConfig{
-		User:            cli.User,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		User:            user,
+		Auth:            auth,
 		Timeout:         3 * time.Minute,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: checkHostKey,
 		BannerCallback: func(message string) error {
 			log.Println("[ERROR] ssh:", message)
 			return nil
 		},
 	}
 
-	if cli.c, err = ssh.Dial("tcp", cli.Addr, conf); err != nil {
+	if via == nil {
+		return ssh.Dial("tcp", addr, conf)
+	}
+
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
 		return
 	}
 
-	cli.closeOnce = new(sync.Once)
+	sc, chans, reqs, err := ssh.NewClientConn(conn, addr, conf)
+	if err != nil {
+		conn.Close()
+		return
+	}
 
+	c = ssh.NewClient(sc, chans, reqs)
 	return
 }
 
-func (cli *SSHClient) keeplive() {
-	defer func() {
-		if e := recover(); e != nil {
-			log.Printf("SSHClient::keeplive crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
-		}
-	}()
-
-	cli.wg.Add(1)
-	defer cli.wg.Done()
-
-	ticker := time.NewTicker(time.Minute * 1)
-
-	log.Println("ssh: keeplive start")
-
-	fn := func() (err error) {
-		defer func() {
-			if e := recover(); e != nil {
-				log.Printf("SSHClient::ping crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
-			}
-		}()
-
-		if err = cli.Ping(); err != nil {
-			cli.Close()
-			if err = cli.dial(); err != nil {
-				log.Println("ssh: reconnect failed.")
-			} else {
-				log.Println("ssh: reconnect success.")
-			}
-		}
+// 从后往前关闭跳板机连接
+func closeHops(hops []*ssh.Client) {
+	for i := len(hops) - 1; i >= 0; i-- {
+		hops[i].Close()
+	}
+}
 
+// 解析 ssh://user@host:port, 端口默认为 22
+func parseURL(remoteURL string) (addr, user string, err error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
 		return
 	}
 
-	running := true
-	for running {
-		select {
-		case <-cli.chDial:
-			fn()
-		case <-ticker.C:
-			fn()
-		case <-cli.chShutdown:
-			running = false
-		}
+	port := u.Port()
+	if len(port) <= 0 {
+		port = "22"
 	}
 
-	log.Println("ssh: keeplive exit.")
+	addr = net.JoinHostPort(u.Hostname(), port)
+	user = u.User.Username()
+	return
+}
+
+func NewSSHClient(opts config.SSHConfig) (cli *SSHClient, err error) {
+	return newSSHClient(opts, false)
 }
 
-func NewSSHClient(remoteURL string, remoteKey string) (cli *SSHClient, err error) {
-	u, err := url.Parse(remoteURL)
+// lazy 为 true 时首次连接失败不返回错误, 由 keeplive 在后台继续重连
+func newSSHClient(opts config.SSHConfig, lazy bool) (cli *SSHClient, err error) {
+	addr, user, err := parseURL(opts.URL)
 	if err != nil {
 		return
 	}
 
 	cli = new(SSHClient)
-	cli.Addr = u.Hostname() + ":" + u.Port()
-	cli.User = u.User.Username()
-	cli.KeyFile = remoteKey
-	cli.chDial = make(chan int)
+	cli.Addr = addr
+	cli.User = user
+	cli.KeyFile = opts.IdentityFile
+	cli.Options = opts
+	cli.chDial = make(chan int, 1)
 	cli.chShutdown = make(chan int)
 
 	if err = cli.dial(); err != nil {
-		cli = nil
-		return
+		if !lazy {
+			cli = nil
+			return
+		}
+
+		log.Printf("[ERROR] ssh: connect %s failed, retry in background: %s", addr, err)
+		cli.state = int32(StateFailed)
+		err = nil
 	}
 
+	cli.wg.Add(1)
 	go cli.keeplive()
 
 	return
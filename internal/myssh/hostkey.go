@@ -0,0 +1,145 @@
+package myssh
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/taodev/goway/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// 只接受 known_hosts 中已有的主机密钥
+	HostKeyStrict = "strict"
+	// 首次连接时记录主机密钥, 之后密钥变化则拒绝连接
+	HostKeyAcceptNew = "accept-new"
+	// 不校验主机密钥
+	HostKeyInsecure = "insecure"
+
+	DEFAULT_KNOWN_HOSTS = "known_hosts"
+)
+
+// 多个客户端可能同时写 known_hosts
+var knownHostsLocker sync.Mutex
+
+// 根据配置生成主机密钥校验函数, 配置了 HostKeys 时只接受其中的指纹
+func hostKeyCallback(opts config.SSHConfig) (cb ssh.HostKeyCallback, err error) {
+	if len(opts.HostKeys) > 0 {
+		cb = pinnedHostKeyCallback(opts.HostKeys)
+		return
+	}
+
+	policy := opts.HostKeyPolicy
+	if len(policy) <= 0 {
+		policy = HostKeyAcceptNew
+	}
+
+	path := opts.KnownHosts
+	if len(path) <= 0 {
+		path = DEFAULT_KNOWN_HOSTS
+	}
+
+	switch policy {
+	case HostKeyInsecure:
+		log.Printf("[WARN] ssh: host key verification disabled for %s", opts.URL)
+		cb = ssh.InsecureIgnoreHostKey()
+	case HostKeyStrict:
+		var check ssh.HostKeyCallback
+		if check, err = knownhosts.New(path); err != nil {
+			return
+		}
+		cb = knownHostsCallback(path, check, false)
+	case HostKeyAcceptNew:
+		knownHostsLocker.Lock()
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600); err == nil {
+			f.Close()
+		}
+		knownHostsLocker.Unlock()
+		if err != nil {
+			return
+		}
+
+		var check ssh.HostKeyCallback
+		if check, err = knownhosts.New(path); err != nil {
+			return
+		}
+		cb = knownHostsCallback(path, check, true)
+	default:
+		err = fmt.Errorf("ssh: unknown host key policy %q", policy)
+	}
+
+	return
+}
+
+func knownHostsCallback(path string, check ssh.HostKeyCallback, acceptNew bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+		err = check(hostname, remote, key)
+		if err == nil {
+			return
+		}
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) > 0 {
+			err = fmt.Errorf("ssh: host key for %s has changed (got %s %s), possible man-in-the-middle attack; remove the old entry from %s if the change is expected",
+				hostname, key.Type(), fingerprint, path)
+			return
+		}
+
+		if !acceptNew {
+			err = fmt.Errorf("ssh: host key for %s (%s %s) not found in %s",
+				hostname, key.Type(), fingerprint, path)
+			return
+		}
+
+		if err = appendKnownHost(path, hostname, key); err != nil {
+			return
+		}
+
+		log.Printf("ssh: added host key for %s (%s %s) to %s", hostname, key.Type(), fingerprint, path)
+		return
+	}
+}
+
+func appendKnownHost(path, hostname string, key ssh.PublicKey) (err error) {
+	knownHostsLocker.Lock()
+	defer knownHostsLocker.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+
+	_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	return
+}
+
+// 固定指纹校验, 指纹格式与 ssh-keygen -l 一致, 如 SHA256:xxxx
+func pinnedHostKeyCallback(fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, v := range fingerprints {
+			if strings.TrimSpace(v) == fingerprint {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("ssh: host key for %s (%s %s) does not match any pinned fingerprint",
+			hostname, key.Type(), fingerprint)
+	}
+}
@@ -1,61 +1,415 @@
 package myssh
 
 import (
+	"errors"
 	"log"
-	"math/rand"
 	"net"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/taodev/goway/config"
+)
+
+const (
+	DEFAULT_POOL_SIZE = 10
+
+	DEFAULT_CHECK_INTERVAL = 30 * time.Second
+	DEFAULT_HYSTERESIS     = 0.2
+
+	// 延迟差小于该值时不切换
+	MIN_RTT_DELTA = 5 * time.Millisecond
 )
 
+const (
+	StrategyPriority = "priority"
+	StrategyLatency  = "latency"
+)
+
+type SSHClientInfo struct {
+	Addr     string
+	Valid    bool
+	Channels int32
+	RTT      time.Duration
+}
+
+type UpstreamInfo struct {
+	URL     string
+	Healthy bool
+	Active  bool
+	RTT     time.Duration
+}
+
+// 一个 ssh 上游及其连接
+type upstream struct {
+	Options config.SSHConfig
+
+	sc      []*SSHClient
+	healthy bool
+	rtt     time.Duration
+}
+
+// 返回通道数最少的可用连接
+func (up *upstream) pick() (sc *SSHClient) {
+	for _, v := range up.sc {
+		if !v.IsValid() {
+			continue
+		}
+
+		if sc == nil || v.Channels() < sc.Channels() {
+			sc = v
+		}
+	}
+
+	return
+}
+
+// 任意一个连接 ping 成功即认为上游可用, 同时返回可用连接的平均延迟
+func (up *upstream) check() (healthy bool, rtt time.Duration) {
+	n := 0
+	for _, v := range up.sc {
+		if !v.IsValid() {
+			continue
+		}
+
+		if err := v.Ping(); err == nil {
+			rtt += v.RTT()
+			n++
+		}
+	}
+
+	if n > 0 {
+		healthy = true
+		rtt /= time.Duration(n)
+	}
+
+	return
+}
+
 // ssh 连接池
 type SSHClientPool struct {
-	URL      string
-	Key      string
-	MaxConns int
+	Options config.FailoverConfig
+
+	// 按优先级排序
+	upstreams []*upstream
+	// 当前使用的上游
+	active    int
+	failovers int64
 
-	sc     []*SSHClient
-	locker sync.RWMutex
+	locker   sync.RWMutex
+	chCheck  chan int
+	chStop   chan int
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 func (pool *SSHClientPool) Dial(n, addr string) (c net.Conn, err error) {
-	var sc *SSHClient
-
 	pool.locker.RLock()
-	if pool.MaxConns <= 0 {
+	sc := pool.upstreams[pool.active].pick()
+	pool.locker.RUnlock()
+
+	// 当前上游没有可用连接时立即切换
+	if sc == nil {
+		sc = pool.failover()
+	}
+
+	if sc == nil {
 		return nil, ErrNotValid
 	}
 
-	// 从连接数组中用随机数挑选一个连接
-	sc = pool.sc[rand.Intn(pool.MaxConns)]
+	return sc.Dial(n, addr)
+}
+
+// 在当前上游的 ssh 服务器上监听
+func (pool *SSHClientPool) Listen(n, addr string) (l net.Listener, err error) {
+	pool.locker.RLock()
+	sc := pool.upstreams[pool.active].pick()
 	pool.locker.RUnlock()
 
-	return sc.Dial(n, addr)
+	if sc == nil {
+		sc = pool.failover()
+	}
+
+	if sc == nil {
+		return nil, ErrNotValid
+	}
+
+	return sc.Listen(n, addr)
 }
 
-func (pool *SSHClientPool) Shutdown() {
+// 切换到优先级最高且有可用连接的上游
+func (pool *SSHClientPool) failover() (sc *SSHClient) {
 	pool.locker.Lock()
 	defer pool.locker.Unlock()
 
-	for i := 0; i < pool.MaxConns; i++ {
-		pool.sc[i].Shutdown()
+	if sc = pool.upstreams[pool.active].pick(); sc != nil {
+		return
+	}
+
+	for k, v := range pool.upstreams {
+		if sc = v.pick(); sc != nil {
+			pool.switchTo(k, "failover")
+			return
+		}
+	}
+
+	return
+}
+
+// 调用方持有写锁
+func (pool *SSHClientPool) switchTo(i int, reason string) {
+	if i == pool.active {
+		return
+	}
+
+	n := atomic.AddInt64(&pool.failovers, 1)
+	log.Printf("[WARN] ssh: %s %s -> %s (total %d)", reason,
+		pool.upstreams[pool.active].Options.URL, pool.upstreams[i].Options.URL, n)
+
+	pool.active = i
+}
+
+// 检查所有上游, 按策略选择使用的上游
+func (pool *SSHClientPool) healthCheck() {
+	healthy := make([]bool, len(pool.upstreams))
+	rtts := make([]time.Duration, len(pool.upstreams))
+	for k, v := range pool.upstreams {
+		healthy[k], rtts[k] = v.check()
+	}
+
+	pool.locker.Lock()
+	defer pool.locker.Unlock()
+
+	for k, v := range pool.upstreams {
+		if v.healthy != healthy[k] {
+			log.Printf("ssh: upstream %s healthy: %v", v.Options.URL, healthy[k])
+		}
+		v.healthy = healthy[k]
+		v.rtt = rtts[k]
+	}
+
+	if pool.Options.Strategy == StrategyLatency {
+		pool.selectFastest()
+		return
+	}
+
+	// 优先级最高的可用上游
+	for k, v := range pool.upstreams {
+		if !v.healthy {
+			continue
+		}
+
+		if k < pool.active {
+			pool.switchTo(k, "failback")
+		} else {
+			pool.switchTo(k, "failover")
+		}
+		return
 	}
 }
 
-func NewSSHClientPool(url, key string, maxConns int) (pool *SSHClientPool, err error) {
-	pool = &SSHClientPool{
-		URL:      url,
-		Key:      key,
-		MaxConns: maxConns,
-		sc:       make([]*SSHClient, maxConns),
+// 选择延迟最低的可用上游, 当前上游可用时只有明显更快才切换, 避免来回切换
+// 调用方持有写锁
+func (pool *SSHClientPool) selectFastest() {
+	best := -1
+	for k, v := range pool.upstreams {
+		if v.healthy && (best < 0 || v.rtt < pool.upstreams[best].rtt) {
+			best = k
+		}
+	}
+
+	if best < 0 || best == pool.active {
+		return
 	}
 
-	for i := 0; i < maxConns; i++ {
-		pool.sc[i], err = NewSSHClient(url, key)
-		if err != nil {
-			log.Printf("[ERROR] NewSSHClientPool NewSSHClient failed, err: %s", err)
+	cur := pool.upstreams[pool.active]
+	if !cur.healthy {
+		pool.switchTo(best, "failover")
+		return
+	}
+
+	hysteresis := pool.Options.Hysteresis
+	if hysteresis <= 0 {
+		hysteresis = DEFAULT_HYSTERESIS
+	}
+
+	rtt := pool.upstreams[best].rtt
+	if float64(rtt) < float64(cur.rtt)*(1-hysteresis) && cur.rtt-rtt > MIN_RTT_DELTA {
+		pool.switchTo(best, "latency")
+	}
+}
+
+// 通知健康检查协程立即检查, 不会阻塞
+func (pool *SSHClientPool) Check() {
+	select {
+	case pool.chCheck <- 0:
+	default:
+	}
+}
+
+func (pool *SSHClientPool) run() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("SSHClientPool::run crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+		}
+	}()
+
+	defer pool.wg.Done()
+
+	interval := pool.Options.CheckInterval
+	if interval <= 0 {
+		interval = DEFAULT_CHECK_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pool.healthCheck()
+		case <-pool.chCheck:
+			pool.healthCheck()
+		case <-pool.chStop:
 			return
 		}
 	}
+}
+
+// 当前使用的上游地址
+func (pool *SSHClientPool) Active() string {
+	pool.locker.RLock()
+	defer pool.locker.RUnlock()
+
+	return pool.upstreams[pool.active].Options.URL
+}
+
+// 故障切换次数
+func (pool *SSHClientPool) Failovers() int64 {
+	return atomic.LoadInt64(&pool.failovers)
+}
+
+func (pool *SSHClientPool) Stats() (infos []SSHClientInfo) {
+	pool.locker.RLock()
+	defer pool.locker.RUnlock()
+
+	for _, up := range pool.upstreams {
+		for _, v := range up.sc {
+			infos = append(infos, SSHClientInfo{
+				Addr:     v.Addr,
+				Valid:    v.IsValid(),
+				Channels: v.Channels(),
+				RTT:      v.RTT(),
+			})
+		}
+	}
+
+	return
+}
+
+func (pool *SSHClientPool) UpstreamStats() (infos []UpstreamInfo) {
+	pool.locker.RLock()
+	defer pool.locker.RUnlock()
+
+	for k, v := range pool.upstreams {
+		infos = append(infos, UpstreamInfo{
+			URL:     v.Options.URL,
+			Healthy: v.healthy,
+			Active:  k == pool.active,
+			RTT:     v.rtt,
+		})
+	}
+
+	return
+}
+
+func (pool *SSHClientPool) Shutdown() {
+	pool.stopOnce.Do(func() {
+		close(pool.chStop)
+	})
+	pool.wg.Wait()
+
+	pool.locker.Lock()
+	defer pool.locker.Unlock()
+
+	for _, up := range pool.upstreams {
+		for _, v := range up.sc {
+			v.Shutdown()
+		}
+	}
+}
+
+func NewSSHClientPool(upstreams []config.SSHConfig, opts config.FailoverConfig) (pool *SSHClientPool, err error) {
+	if len(upstreams) <= 0 {
+		err = errors.New("ssh: no upstream configured")
+		return
+	}
+
+	p := &SSHClientPool{
+		Options: opts,
+		chCheck: make(chan int, 1),
+		chStop:  make(chan int),
+	}
+	pool = p
+
+	for _, v := range upstreams {
+		pool.upstreams = append(pool.upstreams, &upstream{Options: v})
+	}
+
+	sort.SliceStable(pool.upstreams, func(i, j int) bool {
+		return pool.upstreams[i].Options.Priority < pool.upstreams[j].Options.Priority
+	})
+
+	// 多个上游时, 连接失败的上游在后台重连, 只要有一个连接成功即可启动
+	lazy := len(pool.upstreams) > 1
+	connected := false
+
+	for _, up := range pool.upstreams {
+		maxConns := up.Options.PoolSize
+		if maxConns <= 0 {
+			maxConns = DEFAULT_POOL_SIZE
+		}
+
+		for i := 0; i < maxConns; i++ {
+			var sc *SSHClient
+			if sc, err = newSSHClient(up.Options, lazy); err != nil {
+				log.Printf("[ERROR] NewSSHClientPool NewSSHClient failed, err: %s", err)
+				pool.Shutdown()
+				pool = nil
+				return
+			}
+
+			// 连接状态变化时立即检查上游
+			sc.Subscribe(func(State) {
+				p.Check()
+			})
+
+			connected = connected || sc.IsValid()
+			up.sc = append(up.sc, sc)
+		}
+
+		up.healthy = up.pick() != nil
+	}
+
+	if !connected {
+		err = ErrNotValid
+		pool.Shutdown()
+		pool = nil
+		return
+	}
+
+	// 从优先级最高的可用上游开始
+	for k, v := range pool.upstreams {
+		if v.healthy {
+			pool.active = k
+			break
+		}
+	}
+
+	pool.wg.Add(1)
+	go pool.run()
 
 	return
 }
@@ -0,0 +1,198 @@
+package myssh
+
+import (
+	"log"
+	"math/rand"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/taodev/goway/config"
+)
+
+const (
+	DEFAULT_KEEPALIVE_INTERVAL = time.Minute
+
+	DEFAULT_RECONNECT_MIN_INTERVAL = time.Second
+	DEFAULT_RECONNECT_MAX_INTERVAL = time.Minute
+	DEFAULT_RECONNECT_JITTER       = 0.2
+	DEFAULT_RECONNECT_MAX_RETRIES  = 5
+)
+
+// 连接状态
+type State int32
+
+const (
+	StateConnected State = iota
+	StateReconnecting
+	// 连续重连失败超过 MaxRetries 次, 仍会按最大间隔继续重连
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+func (cli *SSHClient) State() State {
+	return State(atomic.LoadInt32(&cli.state))
+}
+
+// 订阅连接状态变化, fn 在 keeplive 协程中调用, 不能阻塞
+func (cli *SSHClient) Subscribe(fn func(State)) {
+	cli.subLocker.Lock()
+	defer cli.subLocker.Unlock()
+
+	cli.subscribers = append(cli.subscribers, fn)
+}
+
+func (cli *SSHClient) setState(s State) {
+	old := State(atomic.SwapInt32(&cli.state, int32(s)))
+	if old == s {
+		return
+	}
+
+	log.Printf("ssh: %s %s -> %s", cli.Addr, old, s)
+
+	cli.subLocker.Lock()
+	subscribers := cli.subscribers
+	cli.subLocker.Unlock()
+
+	for _, fn := range subscribers {
+		fn(s)
+	}
+}
+
+// 指数退避, 第 n 次失败后的等待时间, 带随机抖动
+func backoff(opts config.ReconnectConfig, n int) time.Duration {
+	min := opts.MinInterval
+	if min <= 0 {
+		min = DEFAULT_RECONNECT_MIN_INTERVAL
+	}
+
+	max := opts.MaxInterval
+	if max <= 0 {
+		max = DEFAULT_RECONNECT_MAX_INTERVAL
+	}
+
+	jitter := opts.Jitter
+	if jitter <= 0 {
+		jitter = DEFAULT_RECONNECT_JITTER
+	}
+
+	d := min
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	// [d*(1-jitter), d*(1+jitter)]
+	d = time.Duration(float64(d) * (1 + jitter*(rand.Float64()*2-1)))
+	return d
+}
+
+func (cli *SSHClient) keeplive() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("SSHClient::keeplive crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+		}
+	}()
+
+	defer cli.wg.Done()
+
+	opts := cli.Options.Reconnect
+	maxRetries := opts.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = DEFAULT_RECONNECT_MAX_RETRIES
+	}
+
+	ticker := time.NewTicker(DEFAULT_KEEPALIVE_INTERVAL)
+	defer ticker.Stop()
+
+	retryTimer := time.NewTimer(0)
+	<-retryTimer.C
+	defer retryTimer.Stop()
+
+	// 重连等待中时 retryC 不为空
+	var retryC <-chan time.Time
+	attempts := 0
+
+	log.Println("ssh: keeplive start")
+
+	// 首次连接失败时直接进入重连等待
+	if !cli.IsValid() {
+		attempts = 1
+		retryTimer.Reset(backoff(opts, attempts))
+		retryC = retryTimer.C
+	}
+
+	reconnect := func() {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("SSHClient::reconnect crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+			}
+		}()
+
+		err := cli.dial()
+		if err == nil {
+			attempts = 0
+			retryC = nil
+			log.Println("ssh: reconnect success.")
+			cli.setState(StateConnected)
+			return
+		}
+
+		attempts++
+		d := backoff(opts, attempts)
+		log.Printf("ssh: reconnect %s failed (attempt %d), retry in %s: %s", cli.Addr, attempts, d, err)
+
+		if attempts >= maxRetries {
+			cli.setState(StateFailed)
+		}
+
+		retryTimer.Reset(d)
+		retryC = retryTimer.C
+	}
+
+	check := func() {
+		// 已经在等待重连
+		if retryC != nil {
+			return
+		}
+
+		if err := cli.Ping(); err == nil {
+			return
+		}
+
+		cli.Close()
+		cli.setState(StateReconnecting)
+		reconnect()
+	}
+
+	running := true
+	for running {
+		select {
+		case <-cli.chDial:
+			check()
+		case <-ticker.C:
+			check()
+		case <-retryC:
+			reconnect()
+		case <-cli.chShutdown:
+			running = false
+		}
+	}
+
+	log.Println("ssh: keeplive exit.")
+}
@@ -0,0 +1,159 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 局域网地址在 PAC 中直连
+var pacPrivateNets = [][2]string{
+	{"10.0.0.0", "255.0.0.0"},
+	{"172.16.0.0", "255.240.0.0"},
+	{"192.168.0.0", "255.255.0.0"},
+	{"127.0.0.0", "255.0.0.0"},
+	{"169.254.0.0", "255.255.0.0"},
+}
+
+// 根据路由规则生成代理自动配置 (PAC) 脚本, proxy 为走代理时返回的字符串
+// 规则按顺序转换, direct 返回 DIRECT, 其他动作 (含 reject) 交给代理处理
+// 无法在 PAC 中表达的条件 (geoip, port 等) 视为不匹配, 由代理按完整规则路由;
+// 在此之后的直连规则可能越过这些条件, 因此一并省略
+// isInNet 只用于 IP 字面量, 避免浏览器为每个域名阻塞地解析 DNS, 域名由代理按 ip_cidr 规则匹配
+func (r *Router) PAC(proxy string) []byte {
+	var b bytes.Buffer
+	b.WriteString("// generated by goway from routing rules\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "\tvar proxy = %s;\n", jsString(proxy))
+	b.WriteString("\thost = host.toLowerCase();\n")
+	b.WriteString("\tvar ipv4 = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+
+	uncertain := false
+	for _, v := range r.rules {
+		direct := v.action == ActionDirect
+		if direct && uncertain {
+			fmt.Fprintf(&b, "\t// skipped: %s -> %s\n", pacComment(v.name), v.action)
+			continue
+		}
+
+		var conds []string
+		final := false
+		for _, m := range v.matchers {
+			cond, exact := m.pac()
+			if !exact {
+				uncertain = uncertain || !direct
+			}
+
+			switch cond {
+			case "":
+				continue
+			case "true":
+				final = true
+			}
+			conds = append(conds, cond)
+		}
+
+		if len(conds) <= 0 {
+			fmt.Fprintf(&b, "\t// unsupported: %s -> %s\n", pacComment(v.name), v.action)
+			continue
+		}
+
+		ret := "proxy"
+		if direct {
+			ret = `"DIRECT"`
+		}
+
+		fmt.Fprintf(&b, "\t// %s -> %s\n", pacComment(v.name), v.action)
+		if final {
+			fmt.Fprintf(&b, "\treturn %s;\n}\n", ret)
+			return b.Bytes()
+		}
+		fmt.Fprintf(&b, "\tif (%s)\n\t\treturn %s;\n", strings.Join(conds, " ||\n\t\t"), ret)
+	}
+
+	// 未命中规则时局域网直连, 其他按归属地路由, 交给代理处理
+	if !uncertain {
+		b.WriteString("\t// lan\n")
+		b.WriteString("\tif (isPlainHostName(host) || host == \"localhost\")\n\t\treturn \"DIRECT\";\n")
+		b.WriteString("\tif (ipv4 && (")
+		for k, v := range pacPrivateNets {
+			if k > 0 {
+				b.WriteString(" ||\n\t\t")
+			}
+			fmt.Fprintf(&b, "isInNet(host, %q, %q)", v[0], v[1])
+		}
+		b.WriteString("))\n\t\treturn \"DIRECT\";\n")
+	}
+
+	b.WriteString("\treturn proxy;\n}\n")
+	return b.Bytes()
+}
+
+func jsString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// 规则名可能包含任意字符, 注释中只保留一行
+func pacComment(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func (m domainMatcher) pac() (cond string, exact bool) {
+	return "host == " + jsString(string(m)), true
+}
+
+func (m domainSuffixMatcher) pac() (cond string, exact bool) {
+	return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", jsString(string(m)), jsString("."+string(m))), true
+}
+
+func (m domainKeywordMatcher) pac() (cond string, exact bool) {
+	return fmt.Sprintf("host.indexOf(%s) >= 0", jsString(string(m))), true
+}
+
+// RE2 中 JavaScript 不支持的语法, 脚本出错时浏览器会直连所有请求
+var pacRegexUnsupported = []string{"(?", `\A`, `\z`, `\Q`, `\p`, `\P`, "[[:"}
+
+func (m *domainRegexMatcher) pac() (cond string, exact bool) {
+	expr := m.re.String()
+	for _, v := range pacRegexUnsupported {
+		if strings.Contains(expr, v) {
+			return
+		}
+	}
+
+	return fmt.Sprintf("new RegExp(%s).test(host)", jsString(expr)), true
+}
+
+// shExpMatch 只保证支持 * 和 ?
+func (m globMatcher) pac() (cond string, exact bool) {
+	if strings.ContainsAny(string(m), `[\`) {
+		return
+	}
+
+	return fmt.Sprintf("shExpMatch(host, %s)", jsString(string(m))), true
+}
+
+// isInNet 只支持 IPv4, 且只匹配 IP 字面量, 解析后才能匹配的域名交给代理
+func (m *cidrMatcher) pac() (cond string, exact bool) {
+	ip := m.ipnet.IP.To4()
+	if ip == nil || len(m.ipnet.Mask) != 4 {
+		return
+	}
+
+	mask := m.ipnet.Mask
+	return fmt.Sprintf("ipv4 && isInNet(host, %q, \"%d.%d.%d.%d\")", ip.String(), mask[0], mask[1], mask[2], mask[3]), false
+}
+
+func (m *portMatcher) pac() (cond string, exact bool) {
+	return
+}
+
+func (m geoipMatcher) pac() (cond string, exact bool) {
+	return
+}
+
+func (finalMatcher) pac() (cond string, exact bool) {
+	return "true", true
+}
@@ -0,0 +1,82 @@
+package route
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/taodev/goway/config"
+)
+
+func newTestRouter(t *testing.T, rules ...config.RuleConfig) *Router {
+	t.Helper()
+
+	r, err := NewRouter(config.NodeConfig{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// isInNet 会让浏览器解析域名, 只能用于 IP 字面量
+func TestPACGuardsIsInNet(t *testing.T) {
+	r := newTestRouter(t,
+		config.RuleConfig{Type: "ip_cidr", Values: []string{"10.8.0.0/16"}, Action: "direct"},
+		config.RuleConfig{Type: "domain_suffix", Values: []string{"cn"}, Action: "direct"},
+	)
+	script := string(r.PAC("PROXY p:1"))
+
+	// 每个条件语句中的 isInNet 都必须在 ipv4 判断之后
+	conds := strings.Split(script, "\tif (")[1:]
+	for _, v := range conds {
+		if strings.Contains(v, "isInNet(") && !strings.HasPrefix(v, "ipv4 && ") {
+			t.Fatalf("unguarded isInNet in:\n%s", script)
+		}
+	}
+
+	if n := strings.Count(script, "isInNet("); n != 1+len(pacPrivateNets) {
+		t.Fatalf("%d isInNet calls, want %d:\n%s", n, 1+len(pacPrivateNets), script)
+	}
+}
+
+func TestPACSkipsDirectAfterPartialRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []config.RuleConfig
+		direct bool
+	}{
+		{"exact rule", []config.RuleConfig{
+			{Type: "domain", Values: []string{"a.com"}, Action: "ssh"},
+			{Type: "domain_suffix", Values: []string{"cn"}, Action: "direct"},
+		}, true},
+		// 解析后落在网段内的域名在 PAC 中不会匹配, 后面的直连规则不能越过它
+		{"cidr tunnel", []config.RuleConfig{
+			{Type: "ip_cidr", Values: []string{"1.2.3.0/24"}, Action: "ssh"},
+			{Type: "domain_suffix", Values: []string{"cn"}, Action: "direct"},
+		}, false},
+		{"geoip tunnel", []config.RuleConfig{
+			{Type: "geoip", Values: []string{"US"}, Action: "ssh"},
+			{Type: "domain_suffix", Values: []string{"cn"}, Action: "direct"},
+		}, false},
+		{"cidr direct", []config.RuleConfig{
+			{Type: "ip_cidr", Values: []string{"1.2.3.0/24"}, Action: "direct"},
+			{Type: "domain_suffix", Values: []string{"cn"}, Action: "direct"},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := string(newTestRouter(t, tt.rules...).PAC("PROXY p:1"))
+
+			direct := strings.Contains(script, `dnsDomainIs(host, ".cn")`)
+			if direct != tt.direct {
+				t.Fatalf("direct rule emitted = %v, want %v:\n%s", direct, tt.direct, script)
+			}
+
+			lan := strings.Contains(script, "isPlainHostName(host)")
+			if lan != tt.direct {
+				t.Fatalf("lan rule emitted = %v, want %v:\n%s", lan, tt.direct, script)
+			}
+		})
+	}
+}
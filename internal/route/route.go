@@ -0,0 +1,139 @@
+package route
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/geoip"
+)
+
+type Action string
+
+const (
+	// 本地直连
+	ActionDirect Action = "direct"
+	// 通过 ssh 隧道连接目标地址
+	ActionSSH Action = "ssh"
+	// 通过 ssh 隧道连接跳板代理
+	ActionBridge Action = "bridge"
+	// 拒绝连接
+	ActionReject Action = "reject"
+)
+
+var (
+	ErrRejected = errors.New("route: rejected by rule")
+)
+
+// 路由结果
+type Decision struct {
+	Action Action
+	// 实际需要拨号的地址, bridge 时为跳板地址
+	Addr string
+	// 命中的规则, 用于日志
+	Rule string
+}
+
+// 路由规则引擎, 规则按配置顺序匹配, 第一条命中的规则生效
+type Router struct {
+	rules     []*rule
+	anonymous string
+
+	// 国家代码 -> 是否直连
+	countries map[string]bool
+}
+
+func (r *Router) Route(address string) (d Decision) {
+	t := newTarget(address)
+
+	for _, v := range r.rules {
+		if !v.Match(t) {
+			continue
+		}
+
+		d = Decision{Action: v.action, Addr: address, Rule: v.name}
+		if v.action == ActionBridge {
+			d.Addr = v.bridge
+		}
+		return
+	}
+
+	// 没有命中规则时按归属地决定
+	var ok bool
+	if d, ok = r.routeGeoIP(address); ok {
+		return
+	}
+
+	d = r.tunnel(address, "default")
+	return
+}
+
+func (r *Router) routeGeoIP(address string) (d Decision, ok bool) {
+	isoCode, err := geoip.Lookup(address)
+	if err != nil {
+		log.Printf("route: geoip lookup %s: %s", address, err)
+		d = Decision{Action: ActionDirect, Addr: address, Rule: "geoip(unknown)"}
+		ok = true
+		return
+	}
+
+	name := "geoip(" + isoCode + ")"
+	if isoCode == geoip.LAN {
+		d = Decision{Action: ActionDirect, Addr: address, Rule: name}
+		ok = true
+		return
+	}
+
+	direct, found := r.countries[strings.ToUpper(isoCode)]
+	if !found {
+		return
+	}
+
+	if direct {
+		d = Decision{Action: ActionDirect, Addr: address, Rule: name}
+	} else {
+		d = r.tunnel(address, name)
+	}
+
+	ok = true
+	return
+}
+
+// 走隧道, 配置了匿名跳板时优先使用跳板
+func (r *Router) tunnel(address, name string) (d Decision) {
+	if len(r.anonymous) > 0 {
+		d = Decision{Action: ActionBridge, Addr: r.anonymous, Rule: name + "->anonymous"}
+		return
+	}
+
+	d = Decision{Action: ActionSSH, Addr: address, Rule: name}
+	return
+}
+
+func NewRouter(opts config.NodeConfig) (r *Router, err error) {
+	r = &Router{
+		anonymous: opts.Anonymous,
+		countries: make(map[string]bool),
+	}
+
+	for _, v := range opts.GeoIP.DirectCountries() {
+		r.countries[strings.ToUpper(v)] = true
+	}
+
+	// Tunnel 优先于 Direct
+	for _, v := range opts.GeoIP.Tunnel {
+		r.countries[strings.ToUpper(v)] = false
+	}
+
+	for _, v := range opts.RouteRules() {
+		var rl *rule
+		if rl, err = newRule(v); err != nil {
+			r = nil
+			return
+		}
+		r.rules = append(r.rules, rl)
+	}
+
+	return
+}
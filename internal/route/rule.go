@@ -0,0 +1,245 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/geoip"
+)
+
+// 待匹配的目标地址, IP 在需要时才解析
+type target struct {
+	host string
+	port int
+
+	ip       net.IP
+	resolved bool
+}
+
+func newTarget(address string) (t *target) {
+	t = new(target)
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.host = strings.ToLower(address)
+		return
+	}
+
+	t.host = strings.ToLower(host)
+	t.port, _ = strconv.Atoi(port)
+	return
+}
+
+func (t *target) IP() net.IP {
+	if !t.resolved {
+		t.resolved = true
+		t.ip, _ = geoip.Resolve(t.host)
+	}
+
+	return t.ip
+}
+
+type matcher interface {
+	Match(t *target) bool
+	// 转换为 PAC 中的条件表达式, 无法表达时返回空, 只能匹配部分目标时 exact 为 false
+	pac() (cond string, exact bool)
+}
+
+type domainMatcher string
+
+func (m domainMatcher) Match(t *target) bool {
+	return t.host == string(m)
+}
+
+type domainSuffixMatcher string
+
+func (m domainSuffixMatcher) Match(t *target) bool {
+	suffix := string(m)
+	return t.host == suffix || strings.HasSuffix(t.host, "."+suffix)
+}
+
+type domainKeywordMatcher string
+
+func (m domainKeywordMatcher) Match(t *target) bool {
+	return strings.Contains(t.host, string(m))
+}
+
+type domainRegexMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m *domainRegexMatcher) Match(t *target) bool {
+	return m.re.MatchString(t.host)
+}
+
+type globMatcher string
+
+func (m globMatcher) Match(t *target) bool {
+	ok, _ := filepath.Match(string(m), t.host)
+	return ok
+}
+
+type cidrMatcher struct {
+	ipnet *net.IPNet
+}
+
+func (m *cidrMatcher) Match(t *target) bool {
+	ip := t.IP()
+	return ip != nil && m.ipnet.Contains(ip)
+}
+
+type portMatcher struct {
+	min, max int
+}
+
+func (m *portMatcher) Match(t *target) bool {
+	return t.port >= m.min && t.port <= m.max
+}
+
+type geoipMatcher string
+
+func (m geoipMatcher) Match(t *target) bool {
+	ip := t.IP()
+	if ip == nil || geoip.IsPrivate(ip) {
+		return false
+	}
+
+	isoCode, err := geoip.Country(ip)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(isoCode, string(m))
+}
+
+type finalMatcher struct{}
+
+func (finalMatcher) Match(t *target) bool {
+	return true
+}
+
+func newMatcher(typ, value string) (m matcher, err error) {
+	value = strings.TrimSpace(value)
+
+	switch typ {
+	case "domain":
+		m = domainMatcher(strings.ToLower(value))
+	case "domain_suffix":
+		m = domainSuffixMatcher(strings.TrimPrefix(strings.ToLower(value), "."))
+	case "domain_keyword":
+		m = domainKeywordMatcher(strings.ToLower(value))
+	case "domain_regex":
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(value); err != nil {
+			return
+		}
+		m = &domainRegexMatcher{re: re}
+	case "glob":
+		if _, err = filepath.Match(value, ""); err != nil {
+			return
+		}
+		m = globMatcher(strings.ToLower(value))
+	case "ip_cidr":
+		var ipnet *net.IPNet
+		if _, ipnet, err = net.ParseCIDR(value); err != nil {
+			return
+		}
+		m = &cidrMatcher{ipnet: ipnet}
+	case "port":
+		m, err = newPortMatcher(value)
+	case "geoip":
+		m = geoipMatcher(value)
+	case "final":
+		m = finalMatcher{}
+	default:
+		err = fmt.Errorf("route: unknown rule type %q", typ)
+	}
+
+	return
+}
+
+// 支持单个端口 443 或端口范围 8000-9000
+func newPortMatcher(value string) (m *portMatcher, err error) {
+	m = new(portMatcher)
+
+	lo, hi, found := strings.Cut(value, "-")
+	if m.min, err = strconv.Atoi(lo); err != nil {
+		return
+	}
+
+	m.max = m.min
+	if found {
+		if m.max, err = strconv.Atoi(hi); err != nil {
+			return
+		}
+	}
+
+	if m.min < 0 || m.max > 65535 || m.min > m.max {
+		err = fmt.Errorf("route: invalid port range %q", value)
+	}
+
+	return
+}
+
+type rule struct {
+	name     string
+	action   Action
+	bridge   string
+	matchers []matcher
+}
+
+func (r *rule) Match(t *target) bool {
+	for _, m := range r.matchers {
+		if m.Match(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newRule(opts config.RuleConfig) (r *rule, err error) {
+	r = &rule{
+		name:   opts.Type + "(" + strings.Join(opts.Values, ",") + ")",
+		action: Action(opts.Action),
+		bridge: opts.Bridge,
+	}
+
+	switch r.action {
+	case ActionDirect, ActionSSH, ActionReject:
+	case ActionBridge:
+		if len(r.bridge) <= 0 {
+			err = fmt.Errorf("route: rule %s missing bridge address", r.name)
+			return
+		}
+	default:
+		err = fmt.Errorf("route: rule %s has unknown action %q", r.name, opts.Action)
+		return
+	}
+
+	if opts.Type == "final" {
+		r.name = opts.Type
+		r.matchers = []matcher{finalMatcher{}}
+		return
+	}
+
+	if len(opts.Values) <= 0 {
+		err = fmt.Errorf("route: rule %s has no values", r.name)
+		return
+	}
+
+	for _, v := range opts.Values {
+		var m matcher
+		if m, err = newMatcher(opts.Type, v); err != nil {
+			return
+		}
+		r.matchers = append(r.matchers, m)
+	}
+
+	return
+}
@@ -0,0 +1,34 @@
+package socks
+
+import (
+	"bufio"
+	"net"
+)
+
+// 可以预读数据的连接, 用于识别协议版本
+type PeekConn struct {
+	net.Conn
+
+	r *bufio.Reader
+}
+
+func (c *PeekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// 预读 n 个字节, 不会消耗数据
+func (c *PeekConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+// conn 已经是 PeekConn 时直接返回, 避免重复缓冲
+func NewPeekConn(conn net.Conn) *PeekConn {
+	if pc, ok := conn.(*PeekConn); ok {
+		return pc
+	}
+
+	return &PeekConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
@@ -0,0 +1,191 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// 请求从 r 读取, 回复写入 w
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+var (
+	connectIPv4   = []byte{0x05, CmdConnect, 0x00, AtypIPv4, 1, 2, 3, 4, 0x01, 0xBB}
+	connectIPv6   = append([]byte{0x05, CmdConnect, 0x00, AtypIPv6}, append(net.ParseIP("2001:db8::1").To16(), 0x00, 0x50)...)
+	connectDomain = append([]byte{0x05, CmdConnect, 0x00, AtypDomain, 11}, append([]byte("example.com"), 0x01, 0xBB)...)
+)
+
+func TestSocks5Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		address string
+	}{
+		{"ipv4", connectIPv4, "1.2.3.4:443"},
+		{"ipv6", connectIPv6, "[2001:db8::1]:80"},
+		{"domain", connectDomain, "example.com:443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 每次只返回一个字节, 解析不能依赖一次读完整个请求
+			var reply bytes.Buffer
+			req, err := Socks5Request(readWriter{iotest.OneByteReader(bytes.NewReader(tt.data)), &reply})
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+
+			if addr := req.Address(); addr != tt.address {
+				t.Fatalf("address = %q, want %q", addr, tt.address)
+			}
+			if reply.Len() > 0 {
+				t.Fatalf("unexpected reply %x", reply.Bytes())
+			}
+		})
+	}
+}
+
+func TestSocks5RequestShortRead(t *testing.T) {
+	for _, data := range [][]byte{connectIPv4, connectIPv6, connectDomain} {
+		for n := 0; n < len(data); n++ {
+			var reply bytes.Buffer
+			_, err := Socks5Request(readWriter{bytes.NewReader(data[:n]), &reply})
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				t.Fatalf("%x: err = %v, want EOF", data[:n], err)
+			}
+
+			// 连接已经断开, 不需要回复
+			if reply.Len() > 0 {
+				t.Fatalf("%x: unexpected reply %x", data[:n], reply.Bytes())
+			}
+		}
+	}
+}
+
+func TestSocks5RequestReplyCode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+		rep  byte
+	}{
+		{"bad version", []byte{0x04, CmdConnect, 0x00, AtypIPv4, 1, 2, 3, 4, 0, 80}, ErrSocks5Request, RepGeneralFailure},
+		{"empty domain", []byte{0x05, CmdConnect, 0x00, AtypDomain, 0, 0, 80}, ErrSocks5Request, RepGeneralFailure},
+		{"unknown command", []byte{0x05, 0x09, 0x00, AtypIPv4, 1, 2, 3, 4, 0, 80}, ErrSocks5CommandNotSupported, RepCommandNotSupported},
+		{"unknown address type", []byte{0x05, CmdConnect, 0x00, 0x02, 1, 2, 3, 4, 0, 80}, ErrSocks5AddrTypeNotSupported, RepAddrTypeNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply bytes.Buffer
+			_, err := Socks5Request(readWriter{bytes.NewReader(tt.data), &reply})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+
+			want := []byte{0x05, tt.rep, 0x00, AtypIPv4, 0, 0, 0, 0, 0, 0}
+			if !bytes.Equal(reply.Bytes(), want) {
+				t.Fatalf("reply = %x, want %x", reply.Bytes(), want)
+			}
+		})
+	}
+}
+
+func FuzzSocks5Request(f *testing.F) {
+	f.Add(connectIPv4)
+	f.Add(connectIPv6)
+	f.Add(connectDomain)
+	f.Add([]byte{0x05, 0x09, 0x00, AtypIPv4})
+	f.Add([]byte{0x05, CmdConnect, 0x00, AtypDomain, 0xFF})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var reply bytes.Buffer
+		req, err := Socks5Request(readWriter{bytes.NewReader(data), &reply})
+		if err != nil {
+			// 只会回复一个错误码, 或者在连接断开时不回复
+			if reply.Len() != 0 && (reply.Len() != 10 || reply.Bytes()[0] != 0x05 || reply.Bytes()[1] == RepSuccess) {
+				t.Fatalf("bad error reply %x", reply.Bytes())
+			}
+			return
+		}
+
+		if reply.Len() > 0 {
+			t.Fatalf("unexpected reply %x", reply.Bytes())
+		}
+		if req.Atyp == AtypDomain && (len(req.Host) == 0 || len(req.Host) > 255) {
+			t.Fatalf("bad domain length %d", len(req.Host))
+		}
+		if !strings.HasSuffix(req.Address(), ":"+strconv.Itoa(int(req.DstPort))) {
+			t.Fatalf("bad address %q", req.Address())
+		}
+	})
+}
+
+func FuzzReadAddr(f *testing.F) {
+	f.Add(connectIPv4[3:])
+	f.Add(connectIPv6[3:])
+	f.Add(connectDomain[3:])
+	f.Add([]byte{AtypDomain, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		atyp, ip, host, port, err := ReadAddr(r)
+		if err != nil {
+			return
+		}
+
+		// 重新编码后应与读取的数据一致
+		consumed := data[:len(data)-r.Len()]
+		want := []byte{atyp}
+		switch atyp {
+		case AtypIPv4, AtypIPv6:
+			want = append(want, ip...)
+		case AtypDomain:
+			want = append(want, byte(len(host)))
+			want = append(want, host...)
+		default:
+			t.Fatalf("unexpected atyp %d", atyp)
+		}
+		want = binary.BigEndian.AppendUint16(want, port)
+
+		if !bytes.Equal(consumed, want) {
+			t.Fatalf("consumed %x, re-encoded %x", consumed, want)
+		}
+	})
+}
+
+func FuzzParseUDPDatagram(f *testing.F) {
+	f.Add(append([]byte{0x00, 0x00, 0x00}, append(connectIPv4[3:], "data"...)...))
+	f.Add(append([]byte{0x00, 0x00, 0x00}, connectIPv6[3:]...))
+	f.Add(append([]byte{0x00, 0x00, 0x01}, append(connectDomain[3:], "data"...)...))
+	f.Add([]byte{0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := ParseUDPDatagram(data)
+		if err != nil {
+			if d != nil {
+				t.Fatal("datagram returned with error")
+			}
+			return
+		}
+
+		// 封装后再解析应得到相同的数据包
+		d2, err := ParseUDPDatagram(d.Bytes())
+		if err != nil {
+			t.Fatalf("re-parse %x: %v", d.Bytes(), err)
+		}
+
+		if d2.Frag != d.Frag || d2.Address() != d.Address() || !bytes.Equal(d2.Data, d.Data) {
+			t.Fatalf("round trip mismatch: %+v != %+v", d2, d)
+		}
+	})
+}
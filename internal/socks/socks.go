@@ -1,57 +1,134 @@
 package socks
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
-	"fmt"
+	"io"
 	"net"
-	"time"
+	"strconv"
+
+	"github.com/taodev/goway/internal/auth"
 )
 
 var (
-	ErrSocks5HandshakeRequest = errors.New("socks5 handshake request error")
-	ErrSocks5Request          = errors.New("socks5 request error")
+	ErrSocks5HandshakeRequest     = errors.New("socks5 handshake request error")
+	ErrSocks5Request              = errors.New("socks5 request error")
+	ErrSocks5NoAcceptableMethod   = errors.New("socks5 no acceptable auth method")
+	ErrSocks5Auth                 = errors.New("socks5 username/password auth failed")
+	ErrSocks5CommandNotSupported  = errors.New("socks5 command not supported")
+	ErrSocks5AddrTypeNotSupported = errors.New("socks5 address type not supported")
 )
 
-func Socks5Handshake(conn net.Conn) (err error) {
-	// socks5 handshake request
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil {
+const (
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// RFC 1928 回复码
+const (
+	RepSuccess              = 0x00
+	RepGeneralFailure       = 0x01
+	RepNotAllowed           = 0x02
+	RepNetworkUnreachable   = 0x03
+	RepHostUnreachable      = 0x04
+	RepConnectionRefused    = 0x05
+	RepTTLExpired           = 0x06
+	RepCommandNotSupported  = 0x07
+	RepAddrTypeNotSupported = 0x08
+)
+
+const (
+	// 认证方式
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xFF
+
+	// RFC 1929 子协商版本
+	userPassVersion = 0x01
+)
+
+// socks5 认证方式协商, users 不为空时要求用户名密码认证 (RFC 1929)
+func Socks5Handshake(conn net.Conn, users *auth.Users) (username, password string, err error) {
+	// socks5 handshake request: VER NMETHODS METHODS
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(conn, head); err != nil {
 		return
 	}
 
-	// 二进制打印协议
-	fmt.Printf("n: %d, %x\n", n, buf[:n])
-
-	// socks5 handshake request
-	if n < 3 || buf[0] != 0x05 || buf[1] != 0x01 || buf[2] != 0x00 {
+	if head[0] != 0x05 || head[1] == 0 {
 		err = ErrSocks5HandshakeRequest
 		return
 	}
 
+	methods := make([]byte, head[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	want := byte(MethodNoAuth)
+	if users.Enabled() {
+		want = MethodUserPass
+	}
+
 	// socks5 handshake response
-	_, err = conn.Write([]byte{0x05, 0x00})
-	if err != nil {
+	if bytes.IndexByte(methods, want) < 0 {
+		conn.Write([]byte{0x05, MethodNoAcceptable})
+		err = ErrSocks5NoAcceptableMethod
 		return
 	}
 
-	// // socks5 handshake response
-	// n, err = conn.Read(buf)
-	// if err != nil {
-	// 	return
-	// }
+	if _, err = conn.Write([]byte{0x05, want}); err != nil {
+		return
+	}
 
-	// // 二进制打印协议
-	// fmt.Printf("n: %d, %x\n", n, buf[:n])
-	// // socks5 handshake response
-	// if n < 2 || buf[0] != 0x05 || buf[1] != 0x01 {
-	// 	err = ErrSocks5HandshakeRequest
-	// 	return
-	// }
+	if want == MethodUserPass {
+		username, password, err = socks5UserPassAuth(conn, users)
+	}
 
 	return
 }
 
+// RFC 1929: VER ULEN UNAME PLEN PASSWD
+func socks5UserPassAuth(conn net.Conn, users *auth.Users) (username, password string, err error) {
+	// ULEN 最大 255, 后面还要读 PLEN
+	buf := make([]byte, 256)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+
+	if buf[0] != userPassVersion {
+		err = ErrSocks5Auth
+		return
+	}
+
+	ulen := int(buf[1])
+	if _, err = io.ReadFull(conn, buf[:ulen+1]); err != nil {
+		return
+	}
+	username = string(buf[:ulen])
+
+	plen := int(buf[ulen])
+	if _, err = io.ReadFull(conn, buf[:plen]); err != nil {
+		return
+	}
+	password = string(buf[:plen])
+
+	if !users.Verify(username, password) {
+		conn.Write([]byte{userPassVersion, 0x01})
+		err = ErrSocks5Auth
+		return
+	}
+
+	_, err = conn.Write([]byte{userPassVersion, 0x00})
+	return
+}
+
 type Socks5RequestData struct {
 	Ver      byte
 	Cmd      byte
@@ -62,107 +139,134 @@ type Socks5RequestData struct {
 	Host     string
 	Username string
 	Password string
-	Request  []byte
 }
 
-func Socks5Request(conn net.Conn) (req *Socks5RequestData, err error) {
-	// socks5 request
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return
+// 目标地址, host:port
+func (req *Socks5RequestData) Address() string {
+	host := req.Host
+	if req.Atyp != AtypDomain {
+		host = req.DstAddr.String()
 	}
 
-	// 二进制打印协议
-	fmt.Printf("n: %d, %x\n", n, buf[:n])
+	return net.JoinHostPort(host, strconv.Itoa(int(req.DstPort)))
+}
 
-	// socks5 request
-	if n < 10 || buf[0] != 0x05 || buf[1] != 0x01 {
+// socks5 request: VER CMD RSV ATYP DST.ADDR DST.PORT
+// 解析失败时会按 RFC 1928 回复对应的错误码
+func Socks5Request(rw io.ReadWriter) (req *Socks5RequestData, err error) {
+	head := make([]byte, 3)
+	if _, err = io.ReadFull(rw, head); err != nil {
+		return
+	}
+
+	if head[0] != 0x05 {
+		Socks5Reply(rw, RepGeneralFailure, nil)
 		err = ErrSocks5Request
 		return
 	}
 
-	// socks5 request
 	req = &Socks5RequestData{
-		Ver:     buf[0],
-		Cmd:     buf[1],
-		Rsv:     buf[2],
-		Atyp:    buf[3],
-		Request: buf[:n],
+		Ver: head[0],
+		Cmd: head[1],
+		Rsv: head[2],
 	}
 
-	// socks5 request
-	switch req.Atyp {
-	case 0x01:
-		req.DstAddr = net.IP(buf[4 : 4+net.IPv4len])
-	case 0x03:
-		fmt.Printf("len: %d %s\n", buf[4], buf[5:5+buf[4]])
-		// req.DstAddr = net.IP(buf[5 : 5+buf[4]])
-		req.Host = string(buf[5 : 5+buf[4]])
-	case 0x04:
-		req.DstAddr = net.IP(buf[4 : 4+net.IPv6len])
+	switch req.Cmd {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+	default:
+		Socks5Reply(rw, RepCommandNotSupported, nil)
+		err = ErrSocks5CommandNotSupported
+		return
 	}
 
-	// socks5 request
-	req.DstPort = uint16(buf[n-2])<<8 | uint16(buf[n-1])
+	req.Atyp, req.DstAddr, req.Host, req.DstPort, err = ReadAddr(rw)
+	if err != nil {
+		if err == ErrSocks5AddrTypeNotSupported {
+			Socks5Reply(rw, RepAddrTypeNotSupported, nil)
+		} else if err == ErrSocks5Request {
+			Socks5Reply(rw, RepGeneralFailure, nil)
+		}
+		return
+	}
 
 	return
 }
 
-func Socks5Response(conn net.Conn, req *Socks5RequestData) (err error) {
-	// socks5 response
-	var resp []byte
-	switch req.Atyp {
-	case 0x01:
-		resp = []byte{0x05, 0x00, 0x00, 0x01}
-	case 0x03:
-		resp = []byte{0x05, 0x00, 0x00, 0x03, byte(len(req.Host))}
-	case 0x04:
-		resp = []byte{0x05, 0x00, 0x00, 0x04}
+// 读取 ATYP ADDR PORT
+func ReadAddr(r io.Reader) (atyp byte, ip net.IP, host string, port uint16, err error) {
+	buf := make([]byte, 256)
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		return
 	}
 
-	// socks5 response
-	resp = append(resp, req.DstAddr...)
-	resp = append(resp, byte(req.DstPort>>8), byte(req.DstPort))
+	atyp = buf[0]
+	switch atyp {
+	case AtypIPv4:
+		if _, err = io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+			return
+		}
+		ip = net.IP(append([]byte(nil), buf[:net.IPv4len]...))
+	case AtypIPv6:
+		if _, err = io.ReadFull(r, buf[:net.IPv6len]); err != nil {
+			return
+		}
+		ip = net.IP(append([]byte(nil), buf[:net.IPv6len]...))
+	case AtypDomain:
+		if _, err = io.ReadFull(r, buf[:1]); err != nil {
+			return
+		}
+
+		n := int(buf[0])
+		if n == 0 {
+			err = ErrSocks5Request
+			return
+		}
 
-	// socks5 response
-	_, err = conn.Write(resp)
-	if err != nil {
+		if _, err = io.ReadFull(r, buf[:n]); err != nil {
+			return
+		}
+		host = string(buf[:n])
+	default:
+		err = ErrSocks5AddrTypeNotSupported
+		return
+	}
+
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
 		return
 	}
 
+	port = binary.BigEndian.Uint16(buf[:2])
 	return
 }
 
-func Socks5Connect(conn net.Conn, req *Socks5RequestData) (err error) {
-	// socks5 connect
-	var dstAddr string
-	switch req.Atyp {
-	case 0x01:
-		dstAddr = fmt.Sprintf("%s:%d", req.DstAddr, req.DstPort)
-	case 0x03:
-		dstAddr = fmt.Sprintf("%s:%d", req.Host, req.DstPort)
-	case 0x04:
-		dstAddr = fmt.Sprintf("[%s]:%d", req.DstAddr, req.DstPort)
-	}
+// 按 ATYP ADDR PORT 格式追加地址, addr 为空时使用 0.0.0.0:0
+func AppendAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
 
-	// socks5 connect
-	dstConn, err := net.DialTimeout("tcp", dstAddr, 10*time.Second)
-	if err != nil {
-		return
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
 	}
 
-	// socks5 connect
-	defer dstConn.Close()
-
-	// socks5 connect
-	if req.Cmd == 0x01 {
-		// socks5 connect
-		_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01})
-		if err != nil {
-			return
-		}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, AtypIPv4)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, AtypIPv6)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, AtypIPv4, 0, 0, 0, 0)
 	}
 
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// socks5 reply: VER REP RSV ATYP BND.ADDR BND.PORT
+func Socks5Reply(w io.Writer, rep byte, bindAddr net.Addr) (err error) {
+	resp := AppendAddr([]byte{0x05, rep, 0x00}, bindAddr)
+	_, err = w.Write(resp)
 	return
 }
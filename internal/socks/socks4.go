@@ -0,0 +1,131 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+var (
+	ErrSocks4Request = errors.New("socks4 request error")
+	ErrSocks4Auth    = errors.New("socks4 does not support password auth")
+)
+
+const (
+	Socks4Version = 0x04
+	Socks5Version = 0x05
+
+	// socks4 回复码
+	Socks4Granted  = 0x5A
+	Socks4Rejected = 0x5B
+
+	// userid 和 4a 域名的最大长度
+	socks4MaxField = 255
+)
+
+// socks4 request: VN CD DSTPORT DSTIP USERID NULL
+// socks4a: DSTIP 为 0.0.0.x (x != 0) 时, USERID 后跟 DOMAIN NULL
+// 返回的请求 Ver 为 4, Username 为 USERID
+func Socks4Request(rw io.ReadWriter) (req *Socks5RequestData, err error) {
+	head := make([]byte, 8)
+	if _, err = io.ReadFull(rw, head); err != nil {
+		return
+	}
+
+	if head[0] != Socks4Version {
+		err = ErrSocks4Request
+		return
+	}
+
+	req = &Socks5RequestData{
+		Ver:     head[0],
+		Cmd:     head[1],
+		Atyp:    AtypIPv4,
+		DstPort: binary.BigEndian.Uint16(head[2:4]),
+		DstAddr: net.IP(append([]byte(nil), head[4:8]...)),
+	}
+
+	if req.Username, err = readCString(rw); err != nil {
+		return
+	}
+
+	switch req.Cmd {
+	case CmdConnect, CmdBind:
+	default:
+		Socks4Reply(rw, Socks4Rejected, nil)
+		err = ErrSocks5CommandNotSupported
+		return
+	}
+
+	// socks4a
+	ip := req.DstAddr
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if req.Host, err = readCString(rw); err != nil {
+			return
+		}
+
+		if len(req.Host) <= 0 {
+			Socks4Reply(rw, Socks4Rejected, nil)
+			err = ErrSocks4Request
+			return
+		}
+
+		req.Atyp = AtypDomain
+	}
+
+	return
+}
+
+// 读取以 NULL 结尾的字符串
+func readCString(r io.Reader) (s string, err error) {
+	buf := make([]byte, 0, 32)
+	b := make([]byte, 1)
+	for {
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+
+		if b[0] == 0 {
+			break
+		}
+
+		if len(buf) >= socks4MaxField {
+			err = ErrSocks4Request
+			return
+		}
+
+		buf = append(buf, b[0])
+	}
+
+	s = string(buf)
+	return
+}
+
+// socks4 reply: VN(0) CD DSTPORT DSTIP, 只支持 IPv4 地址
+func Socks4Reply(w io.Writer, rep byte, bindAddr net.Addr) (err error) {
+	resp := make([]byte, 8)
+	resp[1] = rep
+
+	if a, ok := bindAddr.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(resp[2:4], uint16(a.Port))
+		if ip4 := a.IP.To4(); ip4 != nil {
+			copy(resp[4:8], ip4)
+		}
+	}
+
+	_, err = w.Write(resp)
+	return
+}
+
+// 按请求的协议版本回复, rep 为 socks5 回复码, socks4 只区分成功和失败
+func (req *Socks5RequestData) Reply(w io.Writer, rep byte, bindAddr net.Addr) error {
+	if req.Ver == Socks4Version {
+		if rep == RepSuccess {
+			return Socks4Reply(w, Socks4Granted, bindAddr)
+		}
+		return Socks4Reply(w, Socks4Rejected, bindAddr)
+	}
+
+	return Socks5Reply(w, rep, bindAddr)
+}
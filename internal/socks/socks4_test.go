@@ -0,0 +1,145 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var (
+	socks4Connect  = []byte{0x04, CmdConnect, 0x01, 0xBB, 1, 2, 3, 4, 'u', 's', 'e', 'r', 0}
+	socks4aConnect = append([]byte{0x04, CmdConnect, 0x00, 0x50, 0, 0, 0, 1, 'u', 0}, append([]byte("example.com"), 0)...)
+)
+
+func TestSocks4Request(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		atyp     byte
+		address  string
+		username string
+	}{
+		{"socks4", socks4Connect, AtypIPv4, "1.2.3.4:443", "user"},
+		{"socks4a", socks4aConnect, AtypDomain, "example.com:80", "u"},
+		// 0.0.0.0 不是 4a 标记, USERID 之后没有域名
+		{"zero ip", []byte{0x04, CmdConnect, 0x00, 0x50, 0, 0, 0, 0, 0}, AtypIPv4, "0.0.0.0:80", ""},
+		// 0.0.0.x 的最后一个字节可以是任意非零值
+		{"socks4a marker 255", []byte{0x04, CmdBind, 0x00, 0x50, 0, 0, 0, 255, 0, 'a', 0}, AtypDomain, "a:80", ""},
+		{"max field length", append(append([]byte{0x04, CmdConnect, 0x00, 0x50, 0, 0, 0, 1}, strings.Repeat("u", 255)...), append([]byte{0}, strings.Repeat("d", 255)+"\x00"...)...), AtypDomain, strings.Repeat("d", 255) + ":80", strings.Repeat("u", 255)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 每次只返回一个字节, 解析不能依赖一次读完整个请求
+			var reply bytes.Buffer
+			r := bytes.NewReader(tt.data)
+			req, err := Socks4Request(readWriter{iotest.OneByteReader(r), &reply})
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+
+			if req.Ver != Socks4Version || req.Atyp != tt.atyp {
+				t.Fatalf("ver = %d, atyp = %d, want 4, %d", req.Ver, req.Atyp, tt.atyp)
+			}
+			if addr := req.Address(); addr != tt.address {
+				t.Fatalf("address = %q, want %q", addr, tt.address)
+			}
+			if req.Username != tt.username {
+				t.Fatalf("username = %q, want %q", req.Username, tt.username)
+			}
+			if r.Len() > 0 {
+				t.Fatalf("%d bytes not consumed", r.Len())
+			}
+			if reply.Len() > 0 {
+				t.Fatalf("unexpected reply %x", reply.Bytes())
+			}
+		})
+	}
+}
+
+func TestSocks4RequestShortRead(t *testing.T) {
+	// 包括 USERID 和域名之后缺少 NULL 的情况
+	for _, data := range [][]byte{socks4Connect, socks4aConnect} {
+		for n := 0; n < len(data); n++ {
+			var reply bytes.Buffer
+			_, err := Socks4Request(readWriter{bytes.NewReader(data[:n]), &reply})
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				t.Fatalf("%x: err = %v, want EOF", data[:n], err)
+			}
+
+			// 连接已经断开, 不需要回复
+			if reply.Len() > 0 {
+				t.Fatalf("%x: unexpected reply %x", data[:n], reply.Bytes())
+			}
+		}
+	}
+}
+
+func TestSocks4RequestError(t *testing.T) {
+	head := []byte{0x04, CmdConnect, 0x00, 0x50, 0, 0, 0, 1}
+	long := strings.Repeat("x", socks4MaxField+1)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		err   error
+		reply []byte
+	}{
+		{"bad version", append([]byte{0x05}, socks4Connect[1:]...), ErrSocks4Request, nil},
+		{"userid too long", append(append(head, long...), 0, 'a', 0), ErrSocks4Request, nil},
+		{"domain too long", append(append(head, 0), long+"\x00"...), ErrSocks4Request, nil},
+		{"empty domain", append(head, 0, 0), ErrSocks4Request, []byte{0x00, Socks4Rejected, 0, 0, 0, 0, 0, 0}},
+		{"unknown command", []byte{0x04, CmdUDPAssociate, 0x00, 0x50, 1, 2, 3, 4, 0}, ErrSocks5CommandNotSupported, []byte{0x00, Socks4Rejected, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply bytes.Buffer
+			_, err := Socks4Request(readWriter{bytes.NewReader(tt.data), &reply})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+
+			if !bytes.Equal(reply.Bytes(), tt.reply) {
+				t.Fatalf("reply = %x, want %x", reply.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func FuzzSocks4Request(f *testing.F) {
+	f.Add(socks4Connect)
+	f.Add(socks4aConnect)
+	f.Add([]byte{0x04, CmdConnect, 0x00, 0x50, 0, 0, 0, 0, 0})
+	f.Add([]byte{0x04, CmdConnect, 0x00, 0x50, 0, 0, 0, 1, 0, 0})
+	f.Add([]byte{0x04, 0x09, 0x00, 0x50, 1, 2, 3, 4, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var reply bytes.Buffer
+		req, err := Socks4Request(readWriter{bytes.NewReader(data), &reply})
+		if err != nil {
+			// 只会回复拒绝, 或者不回复
+			if reply.Len() != 0 && (reply.Len() != 8 || reply.Bytes()[1] != Socks4Rejected) {
+				t.Fatalf("bad error reply %x", reply.Bytes())
+			}
+			return
+		}
+
+		if reply.Len() > 0 {
+			t.Fatalf("unexpected reply %x", reply.Bytes())
+		}
+		if len(req.Username) > socks4MaxField {
+			t.Fatalf("bad userid length %d", len(req.Username))
+		}
+		if req.Atyp == AtypDomain && (len(req.Host) == 0 || len(req.Host) > socks4MaxField) {
+			t.Fatalf("bad domain length %d", len(req.Host))
+		}
+		if !strings.HasSuffix(req.Address(), ":"+strconv.Itoa(int(req.DstPort))) {
+			t.Fatalf("bad address %q", req.Address())
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/auth"
+)
+
+// 客户端按 RFC 1929 发送用户名密码, 返回服务端的回复
+func userPassAuth(t *testing.T, users *auth.Users, username, password string) (reply []byte, gotUser, gotPass string, err error) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		gotUser, gotPass, err = Socks5Handshake(server, users)
+	}()
+
+	msg := []byte{0x05, 0x01, MethodUserPass, userPassVersion, byte(len(username))}
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+
+	go client.Write(msg)
+
+	reply, _ = io.ReadAll(client)
+	<-done
+	return
+}
+
+func TestSocks5UserPassAuthMaxLength(t *testing.T) {
+	username := strings.Repeat("u", 255)
+	password := strings.Repeat("p", 255)
+	users := auth.NewUsers([]config.UserConfig{{Username: username, Password: password}})
+
+	tests := []struct {
+		name     string
+		password string
+		reply    []byte
+		ok       bool
+	}{
+		{"accepted", password, []byte{0x05, MethodUserPass, userPassVersion, 0x00}, true},
+		{"wrong password", strings.Repeat("x", 255), []byte{0x05, MethodUserPass, userPassVersion, 0x01}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, gotUser, gotPass, err := userPassAuth(t, users, username, tt.password)
+			if !bytes.Equal(reply, tt.reply) {
+				t.Fatalf("reply = %x, want %x", reply, tt.reply)
+			}
+
+			if !tt.ok {
+				if err != ErrSocks5Auth {
+					t.Fatalf("err = %v, want %v", err, ErrSocks5Auth)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if gotUser != username || gotPass != tt.password {
+				t.Fatalf("got %d/%d bytes, want 255/255", len(gotUser), len(gotPass))
+			}
+		})
+	}
+}
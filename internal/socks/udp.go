@@ -0,0 +1,88 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+var (
+	ErrSocks5UDPDatagram = errors.New("socks5 udp datagram error")
+)
+
+// socks5 UDP 数据包: RSV FRAG ATYP DST.ADDR DST.PORT DATA
+type UDPDatagram struct {
+	Frag    byte
+	Atyp    byte
+	DstAddr net.IP
+	Host    string
+	DstPort uint16
+	Data    []byte
+}
+
+// 目标地址, host:port
+func (d *UDPDatagram) Address() string {
+	host := d.Host
+	if d.Atyp != AtypDomain {
+		host = d.DstAddr.String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(d.DstPort)))
+}
+
+// 封装为 socks5 UDP 数据包
+func (d *UDPDatagram) Bytes() []byte {
+	b := make([]byte, 0, 10+len(d.Host)+len(d.Data))
+	b = append(b, 0x00, 0x00, d.Frag)
+
+	switch d.Atyp {
+	case AtypDomain:
+		b = append(b, AtypDomain, byte(len(d.Host)))
+		b = append(b, d.Host...)
+		b = binary.BigEndian.AppendUint16(b, d.DstPort)
+	default:
+		b = AppendAddr(b, &net.UDPAddr{IP: d.DstAddr, Port: int(d.DstPort)})
+	}
+
+	return append(b, d.Data...)
+}
+
+func ParseUDPDatagram(b []byte) (d *UDPDatagram, err error) {
+	if len(b) < 4 || b[0] != 0x00 || b[1] != 0x00 {
+		err = ErrSocks5UDPDatagram
+		return
+	}
+
+	d = &UDPDatagram{
+		Frag: b[2],
+	}
+
+	r := bytes.NewReader(b[3:])
+	if d.Atyp, d.DstAddr, d.Host, d.DstPort, err = ReadAddr(r); err != nil {
+		if err != ErrSocks5AddrTypeNotSupported {
+			err = ErrSocks5UDPDatagram
+		}
+		d = nil
+		return
+	}
+
+	d.Data = b[len(b)-r.Len():]
+	return
+}
+
+// 根据来源地址生成回复给客户端的数据包
+func NewUDPDatagram(from *net.UDPAddr, data []byte) *UDPDatagram {
+	atyp := byte(AtypIPv6)
+	if from.IP.To4() != nil {
+		atyp = AtypIPv4
+	}
+
+	return &UDPDatagram{
+		Atyp:    atyp,
+		DstAddr: from.IP,
+		DstPort: uint16(from.Port),
+		Data:    data,
+	}
+}
@@ -0,0 +1,44 @@
+package stats
+
+import (
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/taodev/goway/internal/geoip"
+	"github.com/taodev/goway/internal/myssh"
+	"github.com/taodev/goway/internal/netflow"
+)
+
+// 开始统计流量, 每 60 秒打印一次流量, 内存, geoip 和 ssh 连接池状态
+func Start(nf *netflow.Netflow, pool *myssh.SSHClientPool) {
+	nf.Start(60, func(i netflow.NetflowInfo) {
+		log.Printf("netflow: conn: %v\ttotal: r-%v w-%v\tspeed: r-%v w-%v",
+			i.ConnTotal,
+			netflow.BytesFormat(i.ReadTotal), netflow.BytesFormat(i.WrittenTotal),
+			netflow.BytesFormat(i.ReadSpeed), netflow.BytesFormat(i.WrittenSpeed),
+		)
+
+		// 打印系统内存使用情况
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		log.Printf("mem: alloc-%v sys-%v heap-%v stack-%v",
+			netflow.BytesFormat(int64(m.Alloc)), netflow.BytesFormat(int64(m.Sys)),
+			netflow.BytesFormat(int64(m.HeapAlloc)), netflow.BytesFormat(int64(m.StackInuse)),
+		)
+
+		g := geoip.Stat()
+		log.Printf("geoip: build-%s update-%s\tdns: size-%v hit-%v miss-%v",
+			g.BuildTime.Format(time.RFC3339), g.LastUpdate.Format(time.RFC3339),
+			g.DNSCache.Size, g.DNSCache.Hits, g.DNSCache.Misses,
+		)
+
+		log.Printf("ssh: failovers-%v", pool.Failovers())
+		for _, v := range pool.UpstreamStats() {
+			log.Printf("ssh: upstream %s active-%v healthy-%v rtt-%v", v.URL, v.Active, v.Healthy, v.RTT)
+		}
+		for k, v := range pool.Stats() {
+			log.Printf("ssh: [%d] %s valid-%v channels-%v rtt-%v", k, v.Addr, v.Valid, v.Channels, v.RTT)
+		}
+	})
+}
@@ -9,7 +9,9 @@ import (
 	"syscall"
 
 	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/geoip"
 	gohttp "github.com/taodev/goway/services/http"
+	"github.com/taodev/goway/services/mixed"
 	"github.com/taodev/goway/services/socks"
 )
 
@@ -33,12 +35,18 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err = geoip.Load(cfg.GeoIP); err != nil {
+		log.Fatalf("load geoip: %s", err)
+	}
+	defer geoip.Close()
+
 	httpServs := make([]*gohttp.HttpServer, 0, len(cfg.Http))
 	for k, v := range cfg.Http {
+		k, v := k, v
 		svr := gohttp.NewHttpServer(v)
 		go func() {
-			if err = svr.Run(); err != nil {
-				log.Printf("start http server: %s failed", k)
+			if err := svr.Run(); err != nil {
+				log.Printf("start http server: %s failed, err:%s", k, err)
 				return
 			}
 		}()
@@ -46,12 +54,13 @@ func main() {
 		httpServs = append(httpServs, svr)
 	}
 
-	socksServs := make([]*socks.SocksV5Server, 0, len(cfg.Http))
+	socksServs := make([]*socks.SocksV5Server, 0, len(cfg.Socks5))
 	for k, v := range cfg.Socks5 {
+		k, v := k, v
 		svr := socks.NewSocksV5Server(v)
 		go func() {
-			if err = svr.Run(); err != nil {
-				log.Printf("start http server: %s failed", k)
+			if err := svr.Run(); err != nil {
+				log.Printf("start socks5 server: %s failed, err:%s", k, err)
 				return
 			}
 		}()
@@ -59,6 +68,20 @@ func main() {
 		socksServs = append(socksServs, svr)
 	}
 
+	mixedServs := make([]*mixed.MixedServer, 0, len(cfg.Mixed))
+	for k, v := range cfg.Mixed {
+		k, v := k, v
+		svr := mixed.NewMixedServer(v)
+		go func() {
+			if err := svr.Run(); err != nil {
+				log.Printf("start mixed server: %s failed, err:%s", k, err)
+				return
+			}
+		}()
+
+		mixedServs = append(mixedServs, svr)
+	}
+
 	signalChan := make(chan os.Signal, 1)
 	cleanupDone := make(chan bool)
 	signal.Notify(signalChan,
@@ -84,4 +107,8 @@ func main() {
 	for _, v := range socksServs {
 		v.Shutdown()
 	}
+
+	for _, v := range mixedServs {
+		v.Shutdown()
+	}
 }
@@ -0,0 +1,364 @@
+package http
+
+import (
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/taodev/goway/internal/http"
+	"github.com/taodev/goway/internal/myssh"
+	"github.com/taodev/goway/internal/netflow"
+	"github.com/taodev/goway/internal/route"
+)
+
+// 收到响应头时等待请求体发送结束的时间, 上游通常在收到完整请求体后才回复
+const BODY_DONE_WAIT = 100 * time.Millisecond
+
+// 普通 http 请求的上游连接, 目标相同的后续请求复用该连接
+type upstream struct {
+	host   string
+	action route.Action
+	// 未统计流量的原始连接
+	raw  net.Conn
+	conn *readCounter
+	r    *http.Reader
+	// 已经完成的请求数
+	served int
+}
+
+// 统计从上游读取的字节数, 用于判断失败的请求是否收到过回复
+type readCounter struct {
+	net.Conn
+	n int64
+}
+
+func (c *readCounter) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.n += int64(n)
+	return
+}
+
+// RFC 7231 4.2.2 幂等方法, 重复发送不会产生额外影响
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+
+	return false
+}
+
+func (up *upstream) Close() {
+	if up != nil {
+		http.CloseConn(&up.raw)
+	}
+}
+
+// 连接失败时 action 为失败的路由
+func (svr *HttpServer) dialUpstream(host string) (up *upstream, action route.Action, err error) {
+	raw, d, err := svr.dial(host)
+	action = d.Action
+	if err != nil {
+		return
+	}
+
+	// ssh 通道已经带有超时, 直连需要同样的读写超时
+	if d.Action == route.ActionDirect {
+		raw = &myssh.SSHConn{
+			Conn: raw,
+		}
+	}
+
+	up = &upstream{
+		host:   host,
+		action: d.Action,
+		raw:    raw,
+		conn: &readCounter{
+			Conn: &netflow.NetflowConn{
+				Conn:    raw,
+				Netflow: svr.Netflow,
+			},
+		},
+	}
+
+	var conn net.Conn = up.conn
+	up.r = http.NewReader(&conn, svr.Options.HTTP.MaxHeaderSize)
+
+	return
+}
+
+// 转发普通 http 请求, 客户端保持连接时继续读取后续请求, 每个请求单独路由
+func (svr *HttpServer) Forward(inConn *net.Conn, r *http.Reader, req *http.HTTPRequest) (err error) {
+	inAddr := (*inConn).RemoteAddr().String()
+	inLocalAddr := (*inConn).LocalAddr().String()
+
+	svr.Netflow.AddConn(1)
+
+	var up *upstream
+	// 升级或转为隧道后连接由 IoBind 负责关闭
+	upgraded, tunneled := false, false
+	defer func() {
+		if upgraded || tunneled {
+			return
+		}
+
+		up.Close()
+		http.CloseConn(inConn)
+		svr.Netflow.DelConn(1)
+		log.Printf("conn %s - %s released", inAddr, inLocalAddr)
+	}()
+
+	for {
+		keepAlive := false
+		if up, keepAlive, upgraded, err = svr.roundTrip(inConn, r, req, up); err != nil || upgraded || !keepAlive {
+			return
+		}
+
+		if req, err = r.ReadRequest(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		req.Header.Del("Proxy-Authorization")
+
+		// 同一连接上的 CONNECT 按隧道处理, 不能转发给当前上游
+		if req.IsHTTPS() {
+			up.Close()
+			up = nil
+			svr.Netflow.DelConn(1)
+			tunneled = true
+
+			req.Body = r.Buffered()
+			err = svr.OutToTCP(req.Host, inConn, req)
+			return
+		}
+	}
+}
+
+// 转发一个请求及其响应, 返回后续请求可以复用的上游连接
+func (svr *HttpServer) roundTrip(inConn *net.Conn, r *http.Reader, req *http.HTTPRequest, up *upstream) (next *upstream, keepAlive, upgraded bool, err error) {
+	n, chunked, err := req.ContentLength()
+	if err != nil {
+		up.Close()
+		replyError(*inConn, err, req.Host, "")
+		return
+	}
+
+	// 同时存在时以 chunked 为准, 避免上游按 Content-Length 解析
+	if chunked {
+		req.Header.Del("Content-Length")
+	}
+
+	// 删除逐跳头部前确定客户端是否保持连接
+	reqKeepAlive := req.KeepAlive()
+	svr.rewriteHeader(*inConn, req)
+	if reqKeepAlive && req.Proto == "HTTP/1.0" {
+		req.Header.Set("Connection", "keep-alive")
+	}
+
+	// 目标不同时重新路由
+	if up != nil && up.host != req.Host {
+		up.Close()
+		up = nil
+	}
+
+	var resp *http.Response
+	var action route.Action
+	var early bool
+	for retry := true; ; retry = false {
+		if up == nil {
+			if up, action, err = svr.dialUpstream(req.Host); err != nil {
+				replyError(*inConn, err, req.Host, action)
+				return
+			}
+			log.Printf("conn %s - %s connected [%s]", (*inConn).RemoteAddr(), (*inConn).LocalAddr(), req.Host)
+		}
+
+		// 跳板为 http 代理, 需要完整的 URL
+		action = up.action
+		if action == route.ActionBridge {
+			req.ToAbsoluteForm()
+		} else {
+			req.ToOriginForm()
+		}
+
+		req.Body = nil
+		received := up.conn.n
+		if _, err = up.conn.Write(req.Bytes()); err == nil {
+			resp, early, err = svr.sendBody(inConn, r, req, up, n, chunked)
+		}
+
+		// 复用的连接可能已被上游关闭, 上游没有任何回复时重试一次
+		// 请求可能已经送达, 只重试没有请求体的幂等请求
+		if err != nil && retry && up.served > 0 && up.conn.n == received &&
+			n == 0 && !chunked && idempotent(req.Method) {
+			up.Close()
+			up = nil
+			continue
+		}
+
+		break
+	}
+
+	var bn int64
+	var bchunked bool
+	if err == nil {
+		bn, bchunked, err = resp.ContentLength(req.Method)
+	}
+
+	// 还没有向客户端发送响应, 可以回复错误
+	if err != nil {
+		up.Close()
+		replyError(*inConn, err, req.Host, action)
+		return
+	}
+
+	// 提前回复时请求体没有发送完, 两端连接的状态都不确定, 响应结束后关闭
+	respKeepAlive := resp.KeepAlive() && !early
+	keepAlive = reqKeepAlive && respKeepAlive && bn != http.BodyUntilEOF
+
+	resp.Header.RemoveHopByHop()
+	if resp.StatusCode != 101 {
+		if !keepAlive {
+			resp.Header.Set("Connection", "close")
+		} else if req.Proto == "HTTP/1.0" {
+			resp.Header.Set("Connection", "keep-alive")
+		}
+	}
+
+	if _, err = (*inConn).Write(resp.Bytes()); err != nil {
+		up.Close()
+		return
+	}
+
+	if resp.StatusCode == 101 {
+		upgraded = true
+		svr.upgrade(inConn, r, up)
+		return
+	}
+
+	if err = up.r.CopyBody(*inConn, bn, bchunked); err != nil {
+		up.Close()
+		return
+	}
+
+	up.served++
+	if !respKeepAlive {
+		up.Close()
+		up = nil
+	}
+
+	next = up
+	return
+}
+
+// 发送请求体, 同时读取响应头并把 1xx 中间响应转发给客户端, 返回最终响应
+// 请求体在单独的协程中发送, 以支持 Expect: 100-continue
+// 上游在请求体发送完之前回复 (如 413, 401) 时 early 为 true, 不再等待发送结束
+func (svr *HttpServer) sendBody(inConn *net.Conn, r *http.Reader, req *http.HTTPRequest, up *upstream, n int64, chunked bool) (resp *http.Response, early bool, err error) {
+	var done chan error
+	if n > 0 || chunked {
+		done = make(chan error, 1)
+		gopool.Go(func() {
+			defer func() {
+				if e := recover(); e != nil {
+					log.Printf("sendBody crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+				}
+			}()
+
+			done <- r.CopyBody(up.conn, n, chunked)
+		})
+	}
+
+	for {
+		if resp, err = up.r.ReadResponse(); err != nil {
+			break
+		}
+
+		if resp.StatusCode/100 != 1 || resp.StatusCode == 101 {
+			break
+		}
+
+		resp.Header.RemoveHopByHop()
+		if _, err = (*inConn).Write(resp.Bytes()); err != nil {
+			break
+		}
+	}
+
+	// 出错或提前回复时两端连接都会被关闭, 发送协程随之结束
+	if err != nil || done == nil {
+		return
+	}
+
+	// 发送失败时上游已经给出了回复, 仍然转发该响应
+	select {
+	case e := <-done:
+		early = e != nil
+	case <-time.After(BODY_DONE_WAIT):
+		early = true
+	}
+
+	if early {
+		log.Printf("conn %s - %s early response %d [%s]", (*inConn).RemoteAddr(), (*inConn).LocalAddr(), resp.StatusCode, req.Host)
+	}
+	return
+}
+
+// 转发给上游的请求中可能暴露客户端来源的头部
+var forwardedHeaders = []string{
+	"Via",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// 删除逐跳头部, 按节点配置添加或删除 Via, X-Forwarded-For
+func (svr *HttpServer) rewriteHeader(inConn net.Conn, req *http.HTTPRequest) {
+	req.Header.RemoveHopByHop()
+
+	opts := svr.Options.HTTP
+	if opts.StripForwarded {
+		for _, k := range forwardedHeaders {
+			req.Header.Del(k)
+		}
+	}
+
+	if opts.Via {
+		req.Header.Append("Via", strings.TrimPrefix(req.Proto, "HTTP/")+" goway")
+	}
+
+	if opts.ForwardedFor {
+		if host, _, err := net.SplitHostPort(inConn.RemoteAddr().String()); err == nil {
+			req.Header.Append("X-Forwarded-For", host)
+		}
+	}
+}
+
+// 协议升级 (如 websocket) 后双向转发
+func (svr *HttpServer) upgrade(inConn *net.Conn, r *http.Reader, up *upstream) {
+	if b := up.r.Buffered(); len(b) > 0 {
+		(*inConn).Write(b)
+	}
+
+	if b := r.Buffered(); len(b) > 0 {
+		up.conn.Write(b)
+	}
+
+	inAddr := (*inConn).RemoteAddr().String()
+	inLocalAddr := (*inConn).LocalAddr().String()
+
+	svr.IoBind(*inConn, up.raw, func(err error) {
+		log.Printf("conn %s - %s released [%s] (upgrade)", inAddr, inLocalAddr, up.host)
+
+		http.CloseConn(inConn)
+		up.Close()
+	})
+}
@@ -0,0 +1,259 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/route"
+)
+
+// 启动直连所有目标的代理, 返回监听地址
+func startTestProxy(t *testing.T) string {
+	t.Helper()
+
+	svr := NewHttpServer(config.NodeConfig{
+		Rules: []config.RuleConfig{{Type: "final", Action: "direct"}},
+	})
+
+	var err error
+	if svr.router, err = route.NewRouter(svr.Options); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go svr.executeConn(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// 每个连接只回复第一个请求, 之后读取下一个请求并直接断开, 模拟上游关闭空闲连接
+type flakyUpstream struct {
+	ln net.Listener
+
+	lock     sync.Mutex
+	requests map[string]int
+}
+
+func startFlakyUpstream(t *testing.T) *flakyUpstream {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	up := &flakyUpstream{ln: ln, requests: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go up.serve(conn)
+		}
+	}()
+
+	return up
+}
+
+func (up *flakyUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for i := 0; ; i++ {
+		req, err := nethttp.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+
+		up.lock.Lock()
+		up.requests[req.Method+" "+req.URL.Path]++
+		up.lock.Unlock()
+
+		if i > 0 {
+			return
+		}
+
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	}
+}
+
+func (up *flakyUpstream) count(key string) int {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	return up.requests[key]
+}
+
+func TestForwardRetriesOnlyIdempotent(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		sent   int
+	}{
+		{"GET", nethttp.StatusOK, 2},
+		{"DELETE", nethttp.StatusOK, 2},
+		{"POST", nethttp.StatusBadGateway, 1},
+		{"PATCH", nethttp.StatusBadGateway, 1},
+	}
+
+	proxy := startTestProxy(t)
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			up := startFlakyUpstream(t)
+			target := up.ln.Addr().String()
+
+			conn, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			br := bufio.NewReader(conn)
+			for k, method := range []string{"GET", tt.method} {
+				fmt.Fprintf(conn, "%s http://%s/%d HTTP/1.1\r\nHost: %s\r\nContent-Length: 0\r\n\r\n", method, target, k, target)
+
+				resp, err := nethttp.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+
+				want := nethttp.StatusOK
+				if k > 0 {
+					want = tt.status
+				}
+				if resp.StatusCode != want {
+					t.Fatalf("request %d: status = %d, want %d", k, resp.StatusCode, want)
+				}
+			}
+
+			if n := up.count(tt.method + " /1"); n != tt.sent {
+				t.Fatalf("upstream received %s %d times, want %d", tt.method, n, tt.sent)
+			}
+		})
+	}
+}
+
+// 上游不读取请求体直接回复, 代理应立即转发响应, 而不是等待请求体发送超时
+func TestForwardEarlyResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				nethttp.ReadRequest(bufio.NewReader(conn))
+				fmt.Fprint(conn, "HTTP/1.1 413 Payload Too Large\r\nContent-Length: 3\r\n\r\nbig")
+				<-quit
+			}()
+		}
+	}()
+
+	proxy := startTestProxy(t)
+	target := ln.Addr().String()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 请求体远大于 socket 缓冲区, 上游不读取时发送会阻塞
+	size := 32 << 20
+	go func() {
+		fmt.Fprintf(conn, "POST http://%s/ HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n", target, target, size)
+		conn.Write(make([]byte, size))
+	}()
+
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != nethttp.StatusRequestEntityTooLarge || string(body) != "big" {
+		t.Fatalf("got %d %q, want 413 \"big\"", resp.StatusCode, body)
+	}
+	if !resp.Close {
+		t.Fatal("connection kept alive with an unfinished request body")
+	}
+}
+
+// 错误回复只包含目标和路由, 不包含内部错误信息
+func TestForwardErrorReplyHidesCause(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := ln.Addr().String()
+	ln.Close()
+
+	conn, err := net.Dial("tcp", startTestProxy(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("502 Bad Gateway\n\ntarget: %s\nroute: direct\n", target)
+	if resp.StatusCode != nethttp.StatusBadGateway || string(body) != want {
+		t.Fatalf("got %d %q, want 502 %q", resp.StatusCode, body, want)
+	}
+}
@@ -1,37 +1,41 @@
 package http
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net"
-	"runtime"
+	nethttp "net/http"
 	"runtime/debug"
 	"sync"
 
 	"github.com/bytedance/gopkg/lang/mcache"
 	"github.com/bytedance/gopkg/util/gopool"
 	"github.com/taodev/goway/config"
-	"github.com/taodev/goway/internal/geoip"
+	"github.com/taodev/goway/internal/auth"
 	"github.com/taodev/goway/internal/http"
 	"github.com/taodev/goway/internal/myssh"
 	"github.com/taodev/goway/internal/netflow"
+	"github.com/taodev/goway/internal/route"
+	"github.com/taodev/goway/internal/stats"
 )
 
 type HttpServer struct {
-	netflow.Netflow
+	*netflow.Netflow
 
 	Options  config.NodeConfig
 	Listener net.Listener
 	sshPool  *myssh.SSHClientPool
+	router   *route.Router
+	users    *auth.Users
+
+	// PAC 中同时提供 socks5 代理, 用于同时支持 socks 的端口
+	PACSocks bool
 }
 
 func (svr *HttpServer) ConnectRemoteSSH() (err error) {
 	opts := svr.Options
-	if err = geoip.Load(); err != nil {
-		return
-	}
-
-	if svr.sshPool, err = myssh.NewSSHClientPool(opts.SSH.URL, opts.SSH.IdentityFile, 10); err != nil {
+	if svr.sshPool, err = myssh.NewSSHClientPool(opts.SSHUpstreams(), opts.Failover); err != nil {
 		return
 	}
 
@@ -39,6 +43,12 @@ func (svr *HttpServer) ConnectRemoteSSH() (err error) {
 }
 
 func (svr *HttpServer) ListenTCP() (err error) {
+	if svr.router, err = route.NewRouter(svr.Options); err != nil {
+		return
+	}
+
+	svr.users = auth.NewUsers(svr.Options.Users)
+
 	if err = svr.ConnectRemoteSSH(); err != nil {
 		return
 	}
@@ -48,21 +58,7 @@ func (svr *HttpServer) ListenTCP() (err error) {
 		return
 	}
 
-	svr.Netflow.Start(60, func(i netflow.NetflowInfo) {
-		log.Printf("netflow: conn: %v\ttotal: r-%v w-%v\tspeed: r-%v w-%v",
-			i.ConnTotal,
-			netflow.BytesFormat(i.ReadTotal), netflow.BytesFormat(i.WrittenTotal),
-			netflow.BytesFormat(i.ReadSpeed), netflow.BytesFormat(i.WrittenSpeed),
-		)
-
-		// 打印系统内存使用情况
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
-		log.Printf("mem: alloc-%v sys-%v heap-%v stack-%v",
-			netflow.BytesFormat(int64(m.Alloc)), netflow.BytesFormat(int64(m.Sys)),
-			netflow.BytesFormat(int64(m.HeapAlloc)), netflow.BytesFormat(int64(m.StackInuse)),
-		)
-	})
+	stats.Start(svr.Netflow, svr.sshPool)
 
 	go func() {
 		defer func() {
@@ -98,6 +94,11 @@ func (svr *HttpServer) ListenTCP() (err error) {
 	return
 }
 
+// 处理一个已经接收的连接
+func (svr *HttpServer) ServeConn(conn net.Conn) {
+	svr.executeConn(conn)
+}
+
 func (svr *HttpServer) executeConn(inConn net.Conn) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -105,18 +106,50 @@ func (svr *HttpServer) executeConn(inConn net.Conn) {
 		}
 	}()
 
-	req, err := http.NewHTTPRequest(&inConn, 4096)
+	r := http.NewReader(&inConn, svr.Options.HTTP.MaxHeaderSize)
+	req, err := r.ReadRequest()
 	if err != nil {
 		if err != io.EOF {
-			log.Printf("decoder error , form %s, ERR:%s", err, inConn.RemoteAddr())
+			log.Printf("decoder error , from %s, ERR:%s", inConn.RemoteAddr(), err)
 		}
+
+		if errors.Is(err, http.ErrBadRequest) || errors.Is(err, http.ErrHeaderTooLarge) {
+			http.ErrorReply(inConn, statusCode(err), "", "")
+		}
+
+		http.CloseConn(&inConn)
+		return
+	}
+
+	// 浏览器直接下载 PAC 文件, 不带代理认证
+	if svr.Options.HTTP.PAC && isPACRequest(req) {
+		svr.servePAC(inConn, req)
 		http.CloseConn(&inConn)
 		return
 	}
 
+	// 代理认证
+	if svr.users.Enabled() {
+		username, password, ok := req.ProxyAuth()
+		if !ok || !svr.users.Verify(username, password) {
+			log.Printf("proxy auth failed, from %s, user: %q", inConn.RemoteAddr(), username)
+			req.ProxyAuthRequired("goway")
+			http.CloseConn(&inConn)
+			return
+		}
+	}
+
+	// 认证信息不转发给上游
+	req.Header.Del("Proxy-Authorization")
+
 	address := req.Host
 
-	err = svr.OutToTCP(address, &inConn, &req)
+	if req.IsHTTPS() {
+		req.Body = r.Buffered()
+		err = svr.OutToTCP(address, &inConn, req)
+	} else {
+		err = svr.Forward(&inConn, r, req)
+	}
 
 	if err != nil {
 		log.Printf("connect to %s fail, ERR:%s", address, err)
@@ -124,44 +157,30 @@ func (svr *HttpServer) executeConn(inConn net.Conn) {
 	}
 }
 
+// 建立隧道 (CONNECT)
 func (svr *HttpServer) OutToTCP(address string, inConn *net.Conn, req *http.HTTPRequest) (err error) {
 	inAddr := (*inConn).RemoteAddr().String()
 	inLocalAddr := (*inConn).LocalAddr().String()
 
-	var outConn net.Conn
-	localReply := true
-
-	// 匹配跳板规则
-	bridge, ok := svr.Options.Match(address)
-	if ok {
-		outConn, err = svr.sshPool.Dial("tcp", bridge)
-		log.Println("bridge:", bridge, "host:", address)
-		localReply = false
-	} else {
-		if geoip.InPRC(address) {
-			outConn, err = net.Dial("tcp", address)
-		} else {
-			if len(svr.Options.Anonymous) > 0 {
-				outConn, err = svr.sshPool.Dial("tcp", svr.Options.Anonymous)
-				localReply = false
-			} else {
-				outConn, err = svr.sshPool.Dial("tcp", address)
-			}
-		}
-	}
-
+	outConn, d, err := svr.dial(address)
 	if err != nil {
-		log.Printf("connect to %s, err:%s", address, err)
+		replyError(*inConn, err, address, d.Action)
 		http.CloseConn(inConn)
 		return
 	}
 
 	svr.Netflow.AddConn(1)
 
-	if localReply && req.IsHTTPS() {
+	// 跳板为 http 代理, 由跳板回复
+	if d.Action != route.ActionBridge {
 		req.HTTPSReply()
+		// 客户端可能在收到回复前就发送了数据
+		if len(req.Body) > 0 {
+			outConn.Write(req.Body)
+		}
 	} else {
-		outConn.Write(req.HeadBuf)
+		svr.rewriteHeader(*inConn, req)
+		outConn.Write(req.Bytes())
 	}
 
 	svr.IoBind((*inConn), outConn, func(err error) {
@@ -175,11 +194,57 @@ func (svr *HttpServer) OutToTCP(address string, inConn *net.Conn, req *http.HTTP
 	return
 }
 
+// 按路由规则连接目标地址, 跳板连接的是上级 http 代理
+func (svr *HttpServer) dial(address string) (outConn net.Conn, d route.Decision, err error) {
+	// 匹配路由规则
+	d = svr.router.Route(address)
+	switch d.Action {
+	case route.ActionReject:
+		err = route.ErrRejected
+	case route.ActionDirect:
+		outConn, err = net.Dial("tcp", d.Addr)
+	default:
+		outConn, err = svr.sshPool.Dial("tcp", d.Addr)
+	}
+
+	log.Printf("route: %s -> %s %s [%s]", address, d.Action, d.Addr, d.Rule)
+	return
+}
+
+// 记录完整的错误并回复客户端
+func replyError(inConn net.Conn, err error, host string, action route.Action) {
+	code := statusCode(err)
+	log.Printf("conn %s - %s reply %d [%s] %s, err:%s", inConn.RemoteAddr(), inConn.LocalAddr(), code, host, action, err)
+	http.ErrorReply(inConn, code, host, string(action))
+}
+
+// 根据错误选择回复客户端的状态码
+func statusCode(err error) int {
+	if errors.Is(err, route.ErrRejected) {
+		return nethttp.StatusForbidden
+	}
+
+	if errors.Is(err, http.ErrHeaderTooLarge) {
+		return nethttp.StatusRequestHeaderFieldsTooLarge
+	}
+
+	if errors.Is(err, http.ErrBadRequest) {
+		return nethttp.StatusBadRequest
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nethttp.StatusGatewayTimeout
+	}
+
+	return nethttp.StatusBadGateway
+}
+
 func (svr *HttpServer) IoBind(src, dst net.Conn, fnClose func(err error)) {
 	var one = &sync.Once{}
 	dst = &netflow.NetflowConn{
 		Conn:    dst,
-		Netflow: &svr.Netflow,
+		Netflow: svr.Netflow,
 	}
 
 	gopool.Go(func() {
@@ -219,10 +284,16 @@ func (svr *HttpServer) IoBind(src, dst net.Conn, fnClose func(err error)) {
 	})
 }
 
+// 启动失败时部分资源可能为空
 func (svr *HttpServer) Shutdown() {
-	svr.Listener.Close()
-	svr.Netflow.Stop()
-	svr.sshPool.Shutdown()
+	if svr.Listener != nil {
+		svr.Listener.Close()
+		svr.Netflow.Stop()
+	}
+
+	if svr.sshPool != nil {
+		svr.sshPool.Shutdown()
+	}
 }
 
 func (svr *HttpServer) Run() (err error) {
@@ -237,5 +308,22 @@ func (svr *HttpServer) Run() (err error) {
 func NewHttpServer(opts config.NodeConfig) (svr *HttpServer) {
 	svr = new(HttpServer)
 	svr.Options = opts
+	svr.Netflow = new(netflow.Netflow)
+	return
+}
+
+// 与其他服务共享 ssh 连接池和流量统计, 连接由调用方接收后交给 ServeConn 处理
+func NewSharedHttpServer(opts config.NodeConfig, pool *myssh.SSHClientPool, nf *netflow.Netflow) (svr *HttpServer, err error) {
+	svr = new(HttpServer)
+	svr.Options = opts
+	svr.Netflow = nf
+	svr.sshPool = pool
+
+	if svr.router, err = route.NewRouter(opts); err != nil {
+		svr = nil
+		return
+	}
+
+	svr.users = auth.NewUsers(opts.Users)
 	return
 }
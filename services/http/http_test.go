@@ -0,0 +1,43 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"testing"
+
+	"github.com/taodev/goway/internal/http"
+	"github.com/taodev/goway/internal/route"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"rejected", route.ErrRejected, nethttp.StatusForbidden},
+		{"request header too large", http.ErrHeaderTooLarge, nethttp.StatusRequestHeaderFieldsTooLarge},
+		{"bad request", fmt.Errorf("%w: invalid host", http.ErrBadRequest), nethttp.StatusBadRequest},
+		// 上游的错误不能归咎于客户端
+		{"response header too large", http.ErrResponseHeaderTooLarge, nethttp.StatusBadGateway},
+		{"bad response", fmt.Errorf("%w: invalid status line", http.ErrBadResponse), nethttp.StatusBadGateway},
+		{"timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, nethttp.StatusGatewayTimeout},
+		{"other", errors.New("connection reset"), nethttp.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := statusCode(tt.err); code != tt.code {
+				t.Fatalf("statusCode(%v) = %d, want %d", tt.err, code, tt.code)
+			}
+		})
+	}
+}
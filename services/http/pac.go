@@ -0,0 +1,51 @@
+package http
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/taodev/goway/internal/http"
+)
+
+const PAC_PATH = "/proxy.pac"
+
+// 直接发给本节点 (origin-form) 的 GET /proxy.pac
+func isPACRequest(req *http.HTTPRequest) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+
+	path, _, _ := strings.Cut(req.RequestURI, "?")
+	return path == PAC_PATH
+}
+
+// 回复 PAC 文件, 每次请求根据当前路由规则生成, 代理地址使用客户端访问本节点的地址
+func (svr *HttpServer) servePAC(inConn net.Conn, req *http.HTTPRequest) (err error) {
+	host, _, _ := net.SplitHostPort(req.Host)
+	_, port, _ := net.SplitHostPort(inConn.LocalAddr().String())
+	addr := net.JoinHostPort(host, port)
+
+	proxy := "PROXY " + addr
+	if svr.PACSocks {
+		proxy += "; SOCKS5 " + addr
+	}
+
+	script := svr.router.PAC(proxy)
+	log.Printf("pac: %s -> %s", inConn.RemoteAddr(), proxy)
+
+	if _, err = fmt.Fprintf(inConn, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: application/x-ns-proxy-autoconfig\r\n"+
+		"Content-Length: %d\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Connection: close\r\n\r\n", len(script)); err != nil {
+		return
+	}
+
+	if req.Method != "HEAD" {
+		_, err = inConn.Write(script)
+	}
+
+	return
+}
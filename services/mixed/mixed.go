@@ -0,0 +1,143 @@
+package mixed
+
+import (
+	"log"
+	"net"
+	"runtime/debug"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/http"
+	"github.com/taodev/goway/internal/myssh"
+	"github.com/taodev/goway/internal/netflow"
+	"github.com/taodev/goway/internal/socks"
+	"github.com/taodev/goway/internal/stats"
+	gohttp "github.com/taodev/goway/services/http"
+	gosocks "github.com/taodev/goway/services/socks"
+)
+
+// 同一端口同时提供 http 和 socks4/5 代理, 共享 ssh 连接池和流量统计
+type MixedServer struct {
+	netflow.Netflow
+
+	Options  config.NodeConfig
+	Listener net.Listener
+	sshPool  *myssh.SSHClientPool
+	http     *gohttp.HttpServer
+	socks    *gosocks.SocksV5Server
+}
+
+func (svr *MixedServer) ConnectRemoteSSH() (err error) {
+	opts := svr.Options
+	if svr.sshPool, err = myssh.NewSSHClientPool(opts.SSHUpstreams(), opts.Failover); err != nil {
+		return
+	}
+
+	return
+}
+
+func (svr *MixedServer) ListenTCP() (err error) {
+	if err = svr.ConnectRemoteSSH(); err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			svr.sshPool.Shutdown()
+			svr.sshPool = nil
+		}
+	}()
+
+	if svr.http, err = gohttp.NewSharedHttpServer(svr.Options, svr.sshPool, &svr.Netflow); err != nil {
+		return
+	}
+	svr.http.PACSocks = true
+
+	if svr.socks, err = gosocks.NewSharedSocksV5Server(svr.Options, svr.sshPool, &svr.Netflow); err != nil {
+		return
+	}
+
+	svr.Listener, err = net.Listen("tcp", svr.Options.Addr)
+	if err != nil {
+		return
+	}
+
+	stats.Start(&svr.Netflow, svr.sshPool)
+
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("ListenTCP crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+			}
+		}()
+
+		for {
+			conn, err := svr.Listener.Accept()
+			if err != nil {
+				log.Printf("accept error , ERR:%s", err)
+				break
+			}
+
+			gopool.Go(func() {
+				defer func() {
+					if e := recover(); e != nil {
+						log.Printf("connection handler crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+					}
+				}()
+
+				svr.executeConn(&myssh.SSHConn{
+					Conn: conn,
+				})
+			})
+		}
+	}()
+
+	log.Printf("mixed http(s)/socks proxy on %s", svr.Options.Addr)
+	return
+}
+
+// 根据第一个字节识别协议: 0x04/0x05 为 socks, 其他按 http 处理
+func (svr *MixedServer) executeConn(conn net.Conn) {
+	pc := socks.NewPeekConn(conn)
+	conn = pc
+
+	ver, err := pc.Peek(1)
+	if err != nil {
+		http.CloseConn(&conn)
+		return
+	}
+
+	switch ver[0] {
+	case socks.Socks4Version, socks.Socks5Version:
+		svr.socks.ServeConn(conn)
+	default:
+		svr.http.ServeConn(conn)
+	}
+}
+
+// 启动失败时部分资源可能为空
+func (svr *MixedServer) Shutdown() {
+	if svr.Listener != nil {
+		svr.Listener.Close()
+		svr.Netflow.Stop()
+	}
+
+	if svr.sshPool != nil {
+		svr.sshPool.Shutdown()
+	}
+}
+
+func (svr *MixedServer) Run() (err error) {
+	if err = svr.ListenTCP(); err != nil {
+		log.Println("ListenTCP:", err)
+		return
+	}
+
+	return
+}
+
+func NewMixedServer(opts config.NodeConfig) (svr *MixedServer) {
+	svr = new(MixedServer)
+	svr.Options = opts
+	return
+}
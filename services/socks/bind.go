@@ -0,0 +1,109 @@
+package socks
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/taodev/goway/internal/http"
+	"github.com/taodev/goway/internal/route"
+	"github.com/taodev/goway/internal/socks"
+)
+
+// 等待目标服务器连入的超时时间
+const BIND_TIMEOUT = 2 * time.Minute
+
+// BIND 命令, 打开监听端口等待目标服务器连入 (如 FTP 主动模式)
+// 直连时在本机监听, 隧道时通过 ssh 远程转发在 ssh 服务器上监听
+func (svr *SocksV5Server) Bind(inConn *net.Conn, req *socks.Socks5RequestData) (err error) {
+	address := req.Address()
+
+	ln, err := svr.listen(*inConn, address)
+	if err != nil {
+		req.Reply(*inConn, replyCode(err), nil)
+		return
+	}
+
+	// 第一次回复: 监听地址
+	if err = req.Reply(*inConn, socks.RepSuccess, ln.Addr()); err != nil {
+		ln.Close()
+		return
+	}
+
+	log.Printf("bind %s listen on %s [%s] user: %q", (*inConn).RemoteAddr(), ln.Addr(), address, req.Username)
+
+	outConn, err := acceptPeer(ln, req)
+	ln.Close()
+	if err != nil {
+		req.Reply(*inConn, socks.RepTTLExpired, nil)
+		return
+	}
+
+	// 第二次回复: 连入方地址
+	if err = req.Reply(*inConn, socks.RepSuccess, outConn.RemoteAddr()); err != nil {
+		http.CloseConn(&outConn)
+		return
+	}
+
+	inAddr := (*inConn).RemoteAddr().String()
+	peerAddr := outConn.RemoteAddr().String()
+
+	svr.Netflow.AddConn(1)
+
+	svr.IoBind((*inConn), outConn, func(err error) {
+		log.Printf("bind %s - %s released [%s]", inAddr, peerAddr, address)
+
+		http.CloseConn(inConn)
+		http.CloseConn(&outConn)
+	})
+
+	log.Printf("bind %s - %s connected [%s]", inAddr, peerAddr, address)
+	return
+}
+
+// 按路由规则选择监听位置
+func (svr *SocksV5Server) listen(inConn net.Conn, address string) (ln net.Listener, err error) {
+	d := svr.router.Route(address)
+	switch d.Action {
+	case route.ActionReject:
+		err = route.ErrRejected
+	case route.ActionDirect:
+		localIP := net.IPv4zero
+		if addr, ok := inConn.LocalAddr().(*net.TCPAddr); ok {
+			localIP = addr.IP
+		}
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
+	default:
+		// 跳板只用于出站连接, 监听统一使用 ssh 远程转发
+		ln, err = svr.sshDialer.Listen("tcp", "0.0.0.0:0")
+	}
+
+	log.Printf("route: bind %s -> %s [%s]", address, d.Action, d.Rule)
+	return
+}
+
+// 等待连入, 请求中指定了 IP 时只接受来自该 IP 的连接
+func acceptPeer(ln net.Listener, req *socks.Socks5RequestData) (conn net.Conn, err error) {
+	// ssh 远程转发的监听不支持 deadline, 超时后直接关闭
+	timer := time.AfterFunc(BIND_TIMEOUT, func() {
+		ln.Close()
+	})
+	defer timer.Stop()
+
+	for {
+		if conn, err = ln.Accept(); err != nil {
+			return
+		}
+
+		if req.Atyp == socks.AtypDomain || req.DstAddr.IsUnspecified() {
+			return
+		}
+
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.Equal(req.DstAddr) {
+			return
+		}
+
+		log.Printf("bind unexpected peer %s, want %s", conn.RemoteAddr(), req.DstAddr)
+		conn.Close()
+	}
+}
@@ -1,72 +1,53 @@
 package socks
 
 import (
-	"context"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net"
-	"runtime"
 	"runtime/debug"
 	"sync"
+	"syscall"
 
-	"github.com/armon/go-socks5"
 	"github.com/bytedance/gopkg/lang/mcache"
 	"github.com/bytedance/gopkg/util/gopool"
 	"github.com/taodev/goway/config"
-	"github.com/taodev/goway/internal/geoip"
+	"github.com/taodev/goway/internal/auth"
 	"github.com/taodev/goway/internal/http"
 	"github.com/taodev/goway/internal/myssh"
 	"github.com/taodev/goway/internal/netflow"
+	"github.com/taodev/goway/internal/route"
 	"github.com/taodev/goway/internal/socks"
+	"github.com/taodev/goway/internal/stats"
+	"golang.org/x/crypto/ssh"
 )
 
 type SocksV5Server struct {
-	netflow.Netflow
+	*netflow.Netflow
 
 	Options   config.NodeConfig
 	Listener  net.Listener
-	sshDialer *myssh.SSHClient
-	socks     *socks5.Server
+	sshDialer *myssh.SSHClientPool
+	router    *route.Router
+	users     *auth.Users
 }
 
 func (svr *SocksV5Server) ConnectRemoteSSH() (err error) {
 	opts := svr.Options
-	if err = geoip.Load(); err != nil {
-		return
-	}
-
-	if svr.sshDialer, err = myssh.NewSSHClient(opts.SSH.URL, opts.SSH.IdentityFile); err != nil {
+	if svr.sshDialer, err = myssh.NewSSHClientPool(opts.SSHUpstreams(), opts.Failover); err != nil {
 		return
 	}
 
 	return
 }
 
-func (svr *SocksV5Server) Listen() (err error) {
-	if err = svr.ConnectRemoteSSH(); err != nil {
-		return
-	}
-
-	conf := &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			log.Printf("network: %s socks: %s", network, addr)
-			return svr.sshDialer.Dial(network, addr)
-		},
-	}
-
-	if svr.socks, err = socks5.New(conf); err != nil {
+func (svr *SocksV5Server) ListenTCP() (err error) {
+	if svr.router, err = route.NewRouter(svr.Options); err != nil {
 		return
 	}
 
-	if err = svr.socks.ListenAndServe("tcp", svr.Options.Addr); err != nil {
-		log.Fatal(err)
-	}
+	svr.users = auth.NewUsers(svr.Options.Users)
 
-	return
-}
-
-func (svr *SocksV5Server) ListenTCP() (err error) {
 	if err = svr.ConnectRemoteSSH(); err != nil {
 		return
 	}
@@ -76,21 +57,7 @@ func (svr *SocksV5Server) ListenTCP() (err error) {
 		return
 	}
 
-	svr.Netflow.Start(60, func(i netflow.NetflowInfo) {
-		log.Printf("netflow: conn: %v\ttotal: r-%v w-%v\tspeed: r-%v w-%v",
-			i.ConnTotal,
-			netflow.BytesFormat(i.ReadTotal), netflow.BytesFormat(i.WrittenTotal),
-			netflow.BytesFormat(i.ReadSpeed), netflow.BytesFormat(i.WrittenSpeed),
-		)
-
-		// 打印系统内存使用情况
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
-		log.Printf("mem: alloc-%v sys-%v heap-%v stack-%v",
-			netflow.BytesFormat(int64(m.Alloc)), netflow.BytesFormat(int64(m.Sys)),
-			netflow.BytesFormat(int64(m.HeapAlloc)), netflow.BytesFormat(int64(m.StackInuse)),
-		)
-	})
+	stats.Start(svr.Netflow, svr.sshDialer)
 
 	go func() {
 		defer func() {
@@ -122,11 +89,16 @@ func (svr *SocksV5Server) ListenTCP() (err error) {
 		}
 	}()
 
-	log.Printf("http http(s) proxy on %s", svr.Options.Addr)
+	log.Printf("socks4/5 proxy on %s", svr.Options.Addr)
 	return
 }
 
-// socks5 handshake
+// 处理一个已经接收的连接
+func (svr *SocksV5Server) ServeConn(conn net.Conn) {
+	svr.executeConn(conn)
+}
+
+// socks4/socks5 handshake
 func (svr *SocksV5Server) executeConn(conn net.Conn) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -134,111 +106,179 @@ func (svr *SocksV5Server) executeConn(conn net.Conn) {
 		}
 	}()
 
-	defer conn.Close()
+	// 根据第一个字节识别协议版本
+	pc := socks.NewPeekConn(conn)
+	conn = pc
 
-	// socks5 handshake
-	if err := socks.Socks5Handshake(conn); err != nil {
-		log.Printf("socks5 handshake error , ERR:%s", err)
+	ver, err := pc.Peek(1)
+	if err != nil {
+		http.CloseConn(&conn)
 		return
 	}
 
-	// socks5 request
-	req, err := socks.Socks5Request(conn)
+	var req *socks.Socks5RequestData
+	if ver[0] == socks.Socks4Version {
+		req, err = svr.socks4Request(conn)
+	} else {
+		req, err = svr.socks5Request(conn)
+	}
+
 	if err != nil {
-		log.Printf("socks5 request error , ERR:%s", err)
+		http.CloseConn(&conn)
 		return
 	}
 
-	log.Println("req:", req)
+	address := req.Address()
+
+	switch req.Cmd {
+	case socks.CmdConnect:
+		err = svr.OutToTCP(address, &conn, req)
+	case socks.CmdBind:
+		err = svr.Bind(&conn, req)
+	case socks.CmdUDPAssociate:
+		err = svr.UDPAssociate(conn, req)
+	default:
+		req.Reply(conn, socks.RepCommandNotSupported, nil)
+		err = socks.ErrSocks5CommandNotSupported
+	}
 
-	// socks5 response
-	if err = socks.Socks5Response(conn, req); err != nil {
-		log.Printf("socks5 response error , ERR:%s", err)
-		return
+	if err != nil {
+		log.Printf("connect to %s fail, ERR:%s", address, err)
+		http.CloseConn(&conn)
 	}
+}
 
-	// socks5 connect
-	var address string
-	switch req.Atyp {
-	case 0x01:
-		address = fmt.Sprintf("%s:%d", req.DstAddr, req.DstPort)
-	case 0x03:
-		address = fmt.Sprintf("%s:%d", req.Host, req.DstPort)
-	case 0x04:
-		address = fmt.Sprintf("[%s]:%d", req.DstAddr, req.DstPort)
+func (svr *SocksV5Server) socks5Request(conn net.Conn) (req *socks.Socks5RequestData, err error) {
+	// socks5 handshake
+	username, password, err := socks.Socks5Handshake(conn, svr.users)
+	if err != nil {
+		log.Printf("socks5 handshake error , from %s, user: %q, ERR:%s", conn.RemoteAddr(), username, err)
+		return
 	}
 
-	if err = socks.Socks5Connect(conn, req); err != nil {
-		log.Printf("socks5 connect error , ERR:%s", err)
+	// socks5 request
+	if req, err = socks.Socks5Request(conn); err != nil {
+		log.Printf("socks5 request error , from %s, ERR:%s", conn.RemoteAddr(), err)
 		return
 	}
 
-	err = svr.OutToTCP(address, &conn, req)
+	req.Username = username
+	req.Password = password
+	return
+}
 
-	if err != nil {
-		log.Printf("connect to %s fail, ERR:%s", address, err)
-		http.CloseConn(&conn)
+// socks4 没有密码认证, 开启认证时拒绝 socks4 请求
+func (svr *SocksV5Server) socks4Request(conn net.Conn) (req *socks.Socks5RequestData, err error) {
+	if req, err = socks.Socks4Request(conn); err != nil {
+		log.Printf("socks4 request error , from %s, ERR:%s", conn.RemoteAddr(), err)
+		return
 	}
+
+	if svr.users.Enabled() {
+		socks.Socks4Reply(conn, socks.Socks4Rejected, nil)
+		err = socks.ErrSocks4Auth
+		log.Printf("socks4 request error , from %s, user: %q, ERR:%s", conn.RemoteAddr(), req.Username, err)
+		return
+	}
+
+	return
 }
 
 func (svr *SocksV5Server) OutToTCP(address string, inConn *net.Conn, req *socks.Socks5RequestData) (err error) {
 	inAddr := (*inConn).RemoteAddr().String()
 	inLocalAddr := (*inConn).LocalAddr().String()
 
-	log.Println("targetAddress:", address)
-
-	var outConn net.Conn
-	// 匹配跳板规则
-	bridge, ok := svr.Options.Match(address)
-	if ok {
-		outConn, err = svr.sshDialer.Dial("tcp", bridge)
-		log.Println("bridge:", bridge, "host:", address)
-	} else {
-		if geoip.InPRC(address) {
-			outConn, err = net.Dial("tcp", address)
-		} else {
-			outConn, err = svr.sshDialer.Dial("tcp", address)
-		}
-	}
-
+	outConn, err := svr.dial(address)
 	if err != nil {
-		log.Printf("connect to %s, err:%s", address, err)
-		http.CloseConn(inConn)
+		req.Reply(*inConn, replyCode(err), nil)
 		return
 	}
 
-	// socks5 connect
-	if req.Cmd == 0x01 {
-		// socks5 connect
-		// _, err = (*inConn).Write([]byte{0x05, 0x00, 0x00, 0x01})
-		req.Request[1] = 0x00
-		_, err = (*inConn).Write(req.Request)
-		if err != nil {
-			return
-		}
-
-		// 二进制打印协议
-		fmt.Printf("n: %x\n", req.Request)
+	if err = req.Reply(*inConn, socks.RepSuccess, outConn.LocalAddr()); err != nil {
+		http.CloseConn(&outConn)
+		return
 	}
 
 	svr.Netflow.AddConn(1)
 
 	svr.IoBind((*inConn), outConn, func(err error) {
-		log.Printf("conn %s - %s released [%s]", inAddr, inLocalAddr, req.Host)
+		log.Printf("conn %s - %s released [%s]", inAddr, inLocalAddr, address)
 
 		http.CloseConn(inConn)
 		http.CloseConn(&outConn)
 	})
 
-	log.Printf("conn %s - %s connected [%s]", inAddr, inLocalAddr, req.Host)
+	log.Printf("conn %s - %s connected [%s] user: %q", inAddr, inLocalAddr, address, req.Username)
 	return
 }
 
+// 按路由规则连接目标地址
+func (svr *SocksV5Server) dial(address string) (outConn net.Conn, err error) {
+	// 匹配路由规则
+	d := svr.router.Route(address)
+	switch d.Action {
+	case route.ActionReject:
+		err = route.ErrRejected
+	case route.ActionDirect:
+		outConn, err = net.Dial("tcp", d.Addr)
+	case route.ActionBridge:
+		// 跳板为 http 代理, 需要先建立隧道
+		if outConn, err = svr.sshDialer.Dial("tcp", d.Addr); err == nil {
+			if err = http.Connect(outConn, address); err != nil {
+				outConn.Close()
+			}
+		}
+	default:
+		outConn, err = svr.sshDialer.Dial("tcp", d.Addr)
+	}
+
+	log.Printf("route: %s -> %s %s [%s]", address, d.Action, d.Addr, d.Rule)
+	return
+}
+
+// 根据拨号错误选择 socks5 回复码
+func replyCode(err error) byte {
+	if errors.Is(err, route.ErrRejected) {
+		return socks.RepNotAllowed
+	}
+
+	if errors.Is(err, myssh.ErrNotValid) {
+		return socks.RepNetworkUnreachable
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return socks.RepConnectionRefused
+	}
+
+	// ssh 服务器打开 direct-tcpip 通道失败的原因
+	var chErr *ssh.OpenChannelError
+	if errors.As(err, &chErr) {
+		switch chErr.Reason {
+		case ssh.ConnectionFailed:
+			return socks.RepConnectionRefused
+		case ssh.Prohibited:
+			return socks.RepNotAllowed
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks.RepHostUnreachable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks.RepHostUnreachable
+	}
+
+	return socks.RepGeneralFailure
+}
+
 func (svr *SocksV5Server) IoBind(src, dst net.Conn, fnClose func(err error)) {
 	var one = &sync.Once{}
 	dst = &netflow.NetflowConn{
 		Conn:    dst,
-		Netflow: &svr.Netflow,
+		Netflow: svr.Netflow,
 	}
 
 	gopool.Go(func() {
@@ -278,15 +318,21 @@ func (svr *SocksV5Server) IoBind(src, dst net.Conn, fnClose func(err error)) {
 	})
 }
 
+// 启动失败时部分资源可能为空
 func (svr *SocksV5Server) Shutdown() {
-	svr.Listener.Close()
-	svr.Netflow.Stop()
-	svr.sshDialer.Shutdown()
+	if svr.Listener != nil {
+		svr.Listener.Close()
+		svr.Netflow.Stop()
+	}
+
+	if svr.sshDialer != nil {
+		svr.sshDialer.Shutdown()
+	}
 }
 
 func (svr *SocksV5Server) Run() (err error) {
-	if err = svr.Listen(); err != nil {
-		log.Println("Listen:", err)
+	if err = svr.ListenTCP(); err != nil {
+		log.Println("ListenTCP:", err)
 		return
 	}
 
@@ -296,5 +342,22 @@ func (svr *SocksV5Server) Run() (err error) {
 func NewSocksV5Server(opts config.NodeConfig) (svr *SocksV5Server) {
 	svr = new(SocksV5Server)
 	svr.Options = opts
+	svr.Netflow = new(netflow.Netflow)
+	return
+}
+
+// 与其他服务共享 ssh 连接池和流量统计, 连接由调用方接收后交给 ServeConn 处理
+func NewSharedSocksV5Server(opts config.NodeConfig, pool *myssh.SSHClientPool, nf *netflow.Netflow) (svr *SocksV5Server, err error) {
+	svr = new(SocksV5Server)
+	svr.Options = opts
+	svr.Netflow = nf
+	svr.sshDialer = pool
+
+	if svr.router, err = route.NewRouter(opts); err != nil {
+		svr = nil
+		return
+	}
+
+	svr.users = auth.NewUsers(opts.Users)
 	return
 }
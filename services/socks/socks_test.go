@@ -0,0 +1,83 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/auth"
+	"github.com/taodev/goway/internal/myssh"
+	"github.com/taodev/goway/internal/route"
+	"github.com/taodev/goway/internal/socks"
+	"golang.org/x/crypto/ssh"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReplyCode(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name string
+		err  error
+		rep  byte
+	}{
+		{"rejected", route.ErrRejected, socks.RepNotAllowed},
+		{"ssh not valid", fmt.Errorf("dial: %w", myssh.ErrNotValid), socks.RepNetworkUnreachable},
+		{"direct refused", refused, socks.RepConnectionRefused},
+		{"ssh connect failed", &ssh.OpenChannelError{Reason: ssh.ConnectionFailed, Message: "Connection refused"}, socks.RepConnectionRefused},
+		{"ssh prohibited", &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "open failed"}, socks.RepNotAllowed},
+		{"dns", &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, socks.RepHostUnreachable},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, socks.RepHostUnreachable},
+		// 只按错误类型判断, 不匹配错误信息
+		{"refused in message", errors.New("request refused"), socks.RepGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rep := replyCode(tt.err); rep != tt.rep {
+				t.Fatalf("replyCode(%v) = %#x, want %#x", tt.err, rep, tt.rep)
+			}
+		})
+	}
+}
+
+// 开启认证时 socks4 请求没有办法验证密码, 需要回复拒绝
+func TestSocks4RequestAuthEnabled(t *testing.T) {
+	svr := &SocksV5Server{
+		users: auth.NewUsers([]config.UserConfig{{Username: "user", Password: "pass"}}),
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		_, err = svr.socks4Request(server)
+	}()
+
+	go client.Write([]byte{0x04, socks.CmdConnect, 0x00, 0x50, 1, 2, 3, 4, 'u', 's', 'e', 'r', 0})
+
+	reply, _ := io.ReadAll(client)
+	<-done
+
+	if !errors.Is(err, socks.ErrSocks4Auth) {
+		t.Fatalf("err = %v, want %v", err, socks.ErrSocks4Auth)
+	}
+	if want := []byte{0x00, socks.Socks4Rejected, 0, 0, 0, 0, 0, 0}; !bytes.Equal(reply, want) {
+		t.Fatalf("reply = %x, want %x", reply, want)
+	}
+}
@@ -0,0 +1,352 @@
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/taodev/goway/internal/geoip"
+	"github.com/taodev/goway/internal/http"
+	"github.com/taodev/goway/internal/myssh"
+	"github.com/taodev/goway/internal/route"
+	"github.com/taodev/goway/internal/socks"
+)
+
+const (
+	// 单个 UDP 数据包最大长度
+	MAX_UDP_PACKET = 64 * 1024
+
+	// 通过隧道转发 DNS 查询的超时时间
+	DNS_TUNNEL_TIMEOUT = 10 * time.Second
+
+	// 每个会话同时通过隧道转发的 DNS 查询数, 每个查询占用一个 ssh 通道
+	MAX_DNS_TUNNEL_QUERIES = 8
+)
+
+// 一个 UDP ASSOCIATE 会话, 生命周期与 TCP 控制连接相同
+type udpRelay struct {
+	svr *SocksV5Server
+
+	// 与客户端通信的 UDP 端口
+	conn *net.UDPConn
+	// 直连目标使用的 UDP 端口
+	direct *net.UDPConn
+
+	// 只接受来自控制连接同一 IP 的数据包
+	clientIP net.IP
+
+	client     *net.UDPAddr
+	clientLock sync.RWMutex
+
+	// 正在通过隧道转发的 DNS 查询, 已满时丢弃新的查询
+	dnsSlots chan struct{}
+
+	// 客户端直连发送过的目标, 只接受来自这些地址的回复, 防止他人向会话注入数据包
+	peers     map[string]bool
+	peersLock sync.RWMutex
+
+	// 因隧道只支持 DNS 而丢弃过数据包的目标, 每个目标只记录一次日志
+	tunnelDrops     map[string]bool
+	tunnelDropsLock sync.Mutex
+
+	lastActive int64
+	dropped    int64
+	closeOnce  sync.Once
+}
+
+func (svr *SocksV5Server) UDPAssociate(conn net.Conn, req *socks.Socks5RequestData) (err error) {
+	localIP := net.IPv4zero
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+
+	relay := &udpRelay{
+		svr:         svr,
+		dnsSlots:    make(chan struct{}, MAX_DNS_TUNNEL_QUERIES),
+		peers:       make(map[string]bool),
+		tunnelDrops: make(map[string]bool),
+		lastActive:  time.Now().UnixNano(),
+	}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		relay.clientIP = addr.IP
+	}
+
+	if relay.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: localIP}); err != nil {
+		socks.Socks5Reply(conn, socks.RepGeneralFailure, nil)
+		return
+	}
+
+	if relay.direct, err = net.ListenUDP("udp", nil); err != nil {
+		relay.conn.Close()
+		socks.Socks5Reply(conn, socks.RepGeneralFailure, nil)
+		return
+	}
+
+	if err = socks.Socks5Reply(conn, socks.RepSuccess, relay.conn.LocalAddr()); err != nil {
+		relay.Close()
+		return
+	}
+
+	log.Printf("udp associate %s -> %s user: %q", conn.RemoteAddr(), relay.conn.LocalAddr(), req.Username)
+
+	svr.Netflow.AddConn(1)
+	defer svr.Netflow.DelConn(1)
+
+	gopool.Go(relay.serveClient)
+	gopool.Go(relay.serveDirect)
+
+	// 控制连接关闭后结束会话
+	relay.waitControl(conn)
+	relay.Close()
+	http.CloseConn(&conn)
+
+	log.Printf("udp associate %s released, dropped: %d", conn.RemoteAddr(), atomic.LoadInt64(&relay.dropped))
+	return
+}
+
+// 等待控制连接关闭, 读超时时如果 UDP 仍在活动则继续等待
+func (relay *udpRelay) waitControl(conn net.Conn) {
+	buf := make([]byte, 64)
+	for {
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			last := time.Unix(0, atomic.LoadInt64(&relay.lastActive))
+			if time.Since(last) < myssh.DEFAULT_TIMEOUT {
+				continue
+			}
+		}
+
+		return
+	}
+}
+
+func (relay *udpRelay) Close() {
+	relay.closeOnce.Do(func() {
+		relay.conn.Close()
+		relay.direct.Close()
+	})
+}
+
+func (relay *udpRelay) active() {
+	atomic.StoreInt64(&relay.lastActive, time.Now().UnixNano())
+}
+
+// 发送给客户端
+func (relay *udpRelay) reply(d *socks.UDPDatagram) {
+	relay.clientLock.RLock()
+	client := relay.client
+	relay.clientLock.RUnlock()
+
+	if client == nil {
+		return
+	}
+
+	n, err := relay.conn.WriteToUDP(d.Bytes(), client)
+	if err != nil {
+		return
+	}
+
+	relay.svr.Netflow.Report(0, n)
+	relay.active()
+}
+
+// 读取客户端的数据包并按路由转发
+func (relay *udpRelay) serveClient() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("udpRelay::serveClient crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+		}
+	}()
+
+	buf := make([]byte, MAX_UDP_PACKET)
+	for {
+		n, from, err := relay.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if relay.clientIP != nil && !relay.clientIP.IsUnspecified() && !from.IP.Equal(relay.clientIP) {
+			continue
+		}
+
+		relay.clientLock.Lock()
+		relay.client = from
+		relay.clientLock.Unlock()
+
+		relay.svr.Netflow.Report(n, 0)
+		relay.active()
+
+		d, err := socks.ParseUDPDatagram(buf[:n])
+		// 不支持分片
+		if err != nil || d.Frag != 0 {
+			atomic.AddInt64(&relay.dropped, 1)
+			continue
+		}
+
+		relay.forward(d)
+	}
+}
+
+func (relay *udpRelay) forward(d *socks.UDPDatagram) {
+	address := d.Address()
+
+	r := relay.svr.router.Route(address)
+	switch r.Action {
+	case route.ActionDirect:
+		ip, ok := d.DstAddr, true
+		if d.Atyp == socks.AtypDomain {
+			ip, ok = geoip.Resolve(d.Host)
+		}
+
+		if !ok {
+			atomic.AddInt64(&relay.dropped, 1)
+			return
+		}
+
+		to := &net.UDPAddr{IP: ip, Port: int(d.DstPort)}
+		relay.addPeer(to)
+		relay.direct.WriteToUDP(d.Data, to)
+	case route.ActionSSH, route.ActionBridge:
+		// ssh 隧道只能转发 TCP, DNS 查询改为 DNS over TCP, 其他 UDP 丢弃, 由客户端回退到 TCP
+		if d.DstPort != 53 {
+			atomic.AddInt64(&relay.dropped, 1)
+			relay.logTunnelDrop(address, r.Action)
+			return
+		}
+
+		// 客户端会重试, 超出并发数的查询直接丢弃, 避免占满 ssh 连接池
+		select {
+		case relay.dnsSlots <- struct{}{}:
+		default:
+			atomic.AddInt64(&relay.dropped, 1)
+			return
+		}
+
+		// 数据包缓冲区会被复用
+		query := &socks.UDPDatagram{
+			Atyp:    d.Atyp,
+			DstAddr: d.DstAddr,
+			Host:    d.Host,
+			DstPort: d.DstPort,
+			Data:    append([]byte(nil), d.Data...),
+		}
+
+		gopool.Go(func() {
+			relay.dnsOverTunnel(query)
+		})
+	default:
+		atomic.AddInt64(&relay.dropped, 1)
+	}
+}
+
+// 隧道不支持转发的 UDP 数据包, 每个目标第一次丢弃时记录日志, 方便排查
+func (relay *udpRelay) logTunnelDrop(address string, action route.Action) {
+	relay.tunnelDropsLock.Lock()
+	logged := relay.tunnelDrops[address]
+	relay.tunnelDrops[address] = true
+	relay.tunnelDropsLock.Unlock()
+
+	if !logged {
+		log.Printf("udp %s [%s] dropped, only dns (port 53) can be forwarded through the tunnel", address, action)
+	}
+}
+
+// 读取直连目标的回复
+func (relay *udpRelay) serveDirect() {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("udpRelay::serveDirect crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+		}
+	}()
+
+	buf := make([]byte, MAX_UDP_PACKET)
+	for {
+		n, from, err := relay.direct.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !relay.isPeer(from) {
+			atomic.AddInt64(&relay.dropped, 1)
+			continue
+		}
+
+		relay.reply(socks.NewUDPDatagram(from, buf[:n]))
+	}
+}
+
+func (relay *udpRelay) addPeer(addr *net.UDPAddr) {
+	key := addr.String()
+
+	relay.peersLock.RLock()
+	found := relay.peers[key]
+	relay.peersLock.RUnlock()
+
+	if !found {
+		relay.peersLock.Lock()
+		relay.peers[key] = true
+		relay.peersLock.Unlock()
+	}
+}
+
+func (relay *udpRelay) isPeer(addr *net.UDPAddr) bool {
+	relay.peersLock.RLock()
+	defer relay.peersLock.RUnlock()
+
+	return relay.peers[addr.String()]
+}
+
+// 通过隧道以 DNS over TCP 转发查询
+func (relay *udpRelay) dnsOverTunnel(query *socks.UDPDatagram) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("udpRelay::dnsOverTunnel crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+		}
+	}()
+	defer func() {
+		<-relay.dnsSlots
+	}()
+
+	address := query.Address()
+	conn, err := relay.svr.dial(address)
+	if err != nil {
+		log.Printf("udp dns %s, err:%s", address, err)
+		return
+	}
+	defer conn.Close()
+
+	// ssh 通道不支持 deadline, 超时后直接关闭连接
+	timer := time.AfterFunc(DNS_TUNNEL_TIMEOUT, func() {
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query.Data)), uint16(len(query.Data)))
+	if _, err = conn.Write(append(msg, query.Data...)); err != nil {
+		return
+	}
+
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(head))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return
+	}
+
+	query.Data = resp
+	relay.reply(query)
+}
@@ -0,0 +1,171 @@
+package socks
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/taodev/goway/config"
+	"github.com/taodev/goway/internal/netflow"
+	"github.com/taodev/goway/internal/route"
+	"github.com/taodev/goway/internal/socks"
+)
+
+func TestUDPForwardLimitsTunnelDNS(t *testing.T) {
+	router, err := route.NewRouter(config.NodeConfig{
+		Rules: []config.RuleConfig{{Type: "final", Action: "ssh"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := &udpRelay{
+		svr:      &SocksV5Server{Netflow: new(netflow.Netflow), router: router},
+		dnsSlots: make(chan struct{}, MAX_DNS_TUNNEL_QUERIES),
+	}
+
+	// 并发数已满, 新的查询不能再打开 ssh 通道
+	for i := 0; i < MAX_DNS_TUNNEL_QUERIES; i++ {
+		relay.dnsSlots <- struct{}{}
+	}
+
+	query := &socks.UDPDatagram{
+		Atyp:    socks.AtypIPv4,
+		DstAddr: net.IPv4(8, 8, 8, 8).To4(),
+		DstPort: 53,
+		Data:    []byte("query"),
+	}
+
+	for i := 0; i < 100; i++ {
+		relay.forward(query)
+	}
+
+	if dropped := atomic.LoadInt64(&relay.dropped); dropped != 100 {
+		t.Fatalf("dropped = %d, want 100", dropped)
+	}
+	if n := len(relay.dnsSlots); n != MAX_DNS_TUNNEL_QUERIES {
+		t.Fatalf("slots in use = %d, want %d", n, MAX_DNS_TUNNEL_QUERIES)
+	}
+}
+
+// 隧道只转发 DNS, 其他 UDP 丢弃时每个目标只记录一次日志
+func TestUDPForwardLogsTunnelDrop(t *testing.T) {
+	router, err := route.NewRouter(config.NodeConfig{
+		Rules: []config.RuleConfig{{Type: "final", Action: "ssh"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := &udpRelay{
+		svr:         &SocksV5Server{Netflow: new(netflow.Netflow), router: router},
+		tunnelDrops: make(map[string]bool),
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, port := range []uint16{443, 443, 443, 123} {
+		relay.forward(&socks.UDPDatagram{
+			Atyp:    socks.AtypIPv4,
+			DstAddr: net.IPv4(1, 2, 3, 4).To4(),
+			DstPort: port,
+			Data:    []byte("data"),
+		})
+	}
+
+	if dropped := atomic.LoadInt64(&relay.dropped); dropped != 4 {
+		t.Fatalf("dropped = %d, want 4", dropped)
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, "1.2.3.4:443 [ssh] dropped"); n != 1 {
+		t.Fatalf("1.2.3.4:443 logged %d times, want 1:\n%s", n, out)
+	}
+	if n := strings.Count(out, "1.2.3.4:123 [ssh] dropped"); n != 1 {
+		t.Fatalf("1.2.3.4:123 logged %d times, want 1:\n%s", n, out)
+	}
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// 直连端口只接受客户端发送过的目标的回复
+func TestUDPDirectDropsUnknownSource(t *testing.T) {
+	router, err := route.NewRouter(config.NodeConfig{
+		Rules: []config.RuleConfig{{Type: "final", Action: "direct"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := &udpRelay{
+		svr:    &SocksV5Server{Netflow: new(netflow.Netflow), router: router},
+		conn:   listenUDP(t),
+		direct: listenUDP(t),
+		peers:  make(map[string]bool),
+	}
+	client := listenUDP(t)
+	relay.client = client.LocalAddr().(*net.UDPAddr)
+	go relay.serveDirect()
+
+	target := listenUDP(t)
+	attacker := listenUDP(t)
+	directAddr := relay.direct.LocalAddr()
+
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	relay.forward(&socks.UDPDatagram{
+		Atyp:    socks.AtypIPv4,
+		DstAddr: targetAddr.IP.To4(),
+		DstPort: uint16(targetAddr.Port),
+		Data:    []byte("query"),
+	})
+
+	buf := make([]byte, 1024)
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err = target.ReadFromUDP(buf); err != nil {
+		t.Fatalf("target did not receive the datagram: %v", err)
+	}
+
+	// 先注入, 再由真正的目标回复, 客户端只应收到后者
+	if _, err = attacker.WriteTo([]byte("inject"), directAddr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err = target.WriteTo([]byte("answer"), directAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := socks.ParseUDPDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Data) != "answer" || d.Address() != target.LocalAddr().String() {
+		t.Fatalf("client received %q from %s, want \"answer\" from %s", d.Data, d.Address(), target.LocalAddr())
+	}
+
+	if dropped := atomic.LoadInt64(&relay.dropped); dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+}